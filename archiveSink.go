@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkArchive = "archive"
+
+const (
+	archiveMarkdown = "md"
+	archiveHTML     = "html"
+	// lines of "file\ttitle" from which index page is generated
+	archiveIndexData = ".index"
+)
+
+// archive or archive:md or archive:html
+var (
+	archiveRegex       = regexp.MustCompile(`^archive(?::(md|html))?$`)
+	archiveUnsafeChar  = regexp.MustCompile(`[^a-zA-Z0-9\.\-_]+`)
+	archiveMarkdownChr = regexp.MustCompile("([\\\\`*_\\[\\]<>])")
+)
+
+// archiveSink writes posts to files under ArchiveDir from config, key is
+// the format. Every source gets its own directory with a file per post,
+// downloaded media in a directory next to it and an index page.
+// It writes to the disk of the bot, so only bot admins can use it.
+type archiveSink struct {
+	cp  *Crossposter
+	dir string
+	// guards index files which are rewritten on every post
+	mu sync.Mutex
+}
+
+func newArchiveSink(cp *Crossposter, cfg CrossposterConfig) *archiveSink {
+	return &archiveSink{cp: cp, dir: cfg.ArchiveDir}
+}
+
+func (s *archiveSink) Type() string {
+	return sinkArchive
+}
+
+func (s *archiveSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := archiveRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", "", false, nil
+	}
+	if s.dir == "" {
+		return "", "", true, userError{code: errNotConfigured}
+	}
+	if !s.cp.isUserBotAdmin(c.Sender().ID) {
+		return "", "", true, userError{code: errBotAdminOnly}
+	}
+	format := m[1]
+	if format == "" {
+		format = archiveMarkdown
+	}
+	return format, s.Describe(format), true, nil
+}
+
+func (s *archiveSink) Describe(key string) string {
+	return fmt.Sprintf(i18n["ru"].archiveTo, key)
+}
+
+func (s *archiveSink) deliversCopyHistory() {}
+
+func sanitizeFileName(name string) string {
+	name = strings.Trim(archiveUnsafeChar.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// archiveSourceDir names directory of the source by the site
+// and owner id of the post, if there's one
+func archiveSourceDir(post *preparedPost) string {
+	host := "webhook"
+	if u, err := url.Parse(post.Link.rawPostLink); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if post.ownerID != 0 {
+		return sanitizeFileName(host + "_" + strconv.Itoa(post.ownerID))
+	}
+	return sanitizeFileName(host)
+}
+
+func archiveTitle(post *preparedPost) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(post.text), "\n")
+	line = renderInlineLinks(line, func(s string) string { return s }, func(url string, text string) string {
+		return text
+	})
+	if line == "" && len(post.copyHistory) > 0 {
+		return fmt.Sprintf(i18n["ru"].archiveRepost, archiveTitle(&post.copyHistory[len(post.copyHistory)-1]))
+	}
+	if line == "" {
+		line = i18n["ru"].archiveNoText
+	}
+	if runes := []rune(line); len(runes) > 100 {
+		line = string(runes[:100]) + "…"
+	}
+	return line
+}
+
+// archiveMedia is a downloaded or linked media item, path is relative to the post
+type archiveMedia struct {
+	mediaType int
+	item      mediaItem
+	path      string
+}
+
+func (s *archiveSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	srcDir := filepath.Join(s.dir, archiveSourceDir(post))
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		return "", err
+	}
+	postID := strconv.Itoa(post.ID)
+	if post.ID == 0 {
+		postID = randomHex(4)
+	}
+	name := time.Now().Format("2006-01-02_150405") + "_" + postID
+	filesDir := name + "_files"
+
+	var content string
+	if key == archiveHTML {
+		content = s.renderHTML(post, srcDir, filesDir)
+	} else {
+		content = s.renderMarkdown(post, post.copyHistory, srcDir, filesDir, "")
+	}
+	fileName := name + "." + key
+	if err := os.WriteFile(filepath.Join(srcDir, fileName), []byte(content), 0644); err != nil {
+		return "", err
+	}
+	if err := s.updateIndex(srcDir, key, fileName, archiveTitle(post)); err != nil {
+		log.Printf("Failed to update archive index in %s:\n%s\n", srcDir, err.Error())
+	}
+	return msgRef(filepath.Join(srcDir, fileName)), nil
+}
+
+// downloadAll saves media of the post, videos are only linked
+// because they are mostly players and not files
+func (s *archiveSink) downloadAll(post *preparedPost, srcDir string, filesDir string) []archiveMedia {
+	res := []archiveMedia{}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			am := archiveMedia{mediaType: mediaType, item: m}
+			if !m.isVideo {
+				p, err := archiveDownload(m, srcDir, filesDir)
+				if err != nil {
+					log.Printf("Failed to download %s to archive:\n%s\n", m.url, err.Error())
+				}
+				am.path = p
+			}
+			res = append(res, am)
+		}
+	}
+	return res
+}
+
+func archiveDownload(m mediaItem, srcDir string, filesDir string) (string, error) {
+	body, err := downloadMedia(m.url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if err = os.MkdirAll(filepath.Join(srcDir, filesDir), 0755); err != nil {
+		return "", err
+	}
+	name := m.title
+	if u, err := url.Parse(m.url); err == nil {
+		if name == "" {
+			name = path.Base(u.Path)
+		} else if path.Ext(name) == "" {
+			name += path.Ext(u.Path)
+		}
+	}
+	rel := path.Join(filesDir, randomHex(2)+"_"+sanitizeFileName(name))
+	f, err := os.Create(filepath.Join(srcDir, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, body); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+func mediaLinkText(m mediaItem) string {
+	name := m.title
+	if m.performer != "" {
+		name = m.performer + " - " + name
+	}
+	if name == "" {
+		name = m.url
+	}
+	return name
+}
+
+func escapeMarkdown(s string) string {
+	return archiveMarkdownChr.ReplaceAllString(s, "\\$1")
+}
+
+// renderMarkdown renders the post with the reposted chain as nested quotes.
+// Chain goes from the original post to the latest repost like copy history,
+// quote is the prefix of every line.
+func (s *archiveSink) renderMarkdown(post *preparedPost, chain []preparedPost, srcDir string, filesDir string, quote string) string {
+	var b strings.Builder
+	line := func(l string) {
+		if strings.TrimSpace(l) == "" {
+			b.WriteString(strings.TrimRight(quote, " ") + "\n")
+		} else {
+			b.WriteString(quote + l + "\n")
+		}
+	}
+	if quote == "" {
+		line("# " + escapeMarkdown(archiveTitle(post)))
+		line("")
+	}
+	text := renderInlineLinks(strings.Trim(post.text, " \t\n"), escapeMarkdown, func(url string, text string) string {
+		return "[" + escapeMarkdown(text) + "](" + url + ")"
+	})
+	for _, l := range strings.Split(text, "\n") {
+		// two trailing spaces keep line breaks
+		line(l + "  ")
+	}
+	for _, l := range post.att.links {
+		line("<" + l + ">  ")
+	}
+	line("")
+	for _, m := range s.downloadAll(post, srcDir, filesDir) {
+		target := m.path
+		if target == "" {
+			target = m.item.url
+		}
+		if m.mediaType == mediaPhotoVideo && !m.item.isVideo {
+			line("![](" + target + ")")
+		} else {
+			line("[" + escapeMarkdown(mediaLinkText(m.item)) + "](" + target + ")")
+		}
+		line("")
+	}
+	if len(chain) > 0 {
+		b.WriteString(s.renderMarkdown(&chain[len(chain)-1], chain[:len(chain)-1], srcDir, filesDir, quote+"> "))
+		line("")
+	}
+	if post.Link.rawPostLink != "" {
+		line("[" + escapeMarkdown(post.Link.name) + "](" + post.Link.rawPostLink + ")")
+	}
+	return b.String()
+}
+
+func (s *archiveSink) renderPostHTML(post *preparedPost, chain []preparedPost, srcDir string, filesDir string) string {
+	var b strings.Builder
+	text := renderInlineLinks(strings.Trim(post.text, " \t\n"), html.EscapeString, func(url string, text string) string {
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(text))
+	})
+	b.WriteString("<p>" + strings.ReplaceAll(text, "\n", "<br>\n") + "</p>\n")
+	for _, l := range post.att.links {
+		b.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(l), html.EscapeString(l)))
+	}
+	for _, m := range s.downloadAll(post, srcDir, filesDir) {
+		target := html.EscapeString(m.path)
+		if m.path == "" {
+			target = html.EscapeString(m.item.url)
+		}
+		switch {
+		case m.mediaType == mediaPhotoVideo && !m.item.isVideo:
+			b.WriteString(fmt.Sprintf("<p><img src=\"%s\" style=\"max-width:100%%\"></p>\n", target))
+		case m.mediaType == mediaAudio && m.path != "":
+			b.WriteString(fmt.Sprintf("<p>%s<br><audio controls src=\"%s\"></audio></p>\n",
+				html.EscapeString(mediaLinkText(m.item)), target))
+		default:
+			b.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n", target, html.EscapeString(mediaLinkText(m.item))))
+		}
+	}
+	if len(chain) > 0 {
+		b.WriteString("<blockquote>\n" + s.renderPostHTML(&chain[len(chain)-1], chain[:len(chain)-1], srcDir, filesDir) + "</blockquote>\n")
+	}
+	if post.Link.rawPostLink != "" {
+		b.WriteString(fmt.Sprintf("<p><small><a href=\"%s\">%s</a></small></p>\n",
+			html.EscapeString(post.Link.rawPostLink), html.EscapeString(post.Link.name)))
+	}
+	return b.String()
+}
+
+func archiveHTMLPage(title string, body string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>%s</title></head>
+<body>
+%s</body></html>
+`, html.EscapeString(title), body)
+}
+
+func (s *archiveSink) renderHTML(post *preparedPost, srcDir string, filesDir string) string {
+	title := archiveTitle(post)
+	return archiveHTMLPage(title, "<p><a href=\"index.html\">"+html.EscapeString(i18n["ru"].archiveAllPosts)+"</a></p>\n"+
+		"<h1>"+html.EscapeString(title)+"</h1>\n"+s.renderPostHTML(post, post.copyHistory, srcDir, filesDir))
+}
+
+// updateIndex adds the post to index data of the source
+// and regenerates index page, newest posts first
+func (s *archiveSink) updateIndex(srcDir string, format string, fileName string, title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dataPath := filepath.Join(srcDir, archiveIndexData)
+	f, err := os.OpenFile(dataPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\t%s\n", fileName, strings.ReplaceAll(title, "\t", " "))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries := [][2]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		file, title, ok := strings.Cut(sc.Text(), "\t")
+		// both formats can share the directory, each gets its own index
+		if ok && strings.HasSuffix(file, "."+format) {
+			entries = append(entries, [2]string{file, title})
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	name := filepath.Base(srcDir)
+	if format == archiveHTML {
+		b.WriteString("<h1>" + html.EscapeString(name) + "</h1>\n<ul>\n")
+		for i := len(entries) - 1; i >= 0; i-- {
+			b.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a> %s</li>\n", html.EscapeString(entries[i][0]),
+				html.EscapeString(entries[i][0][:len("2006-01-02")]), html.EscapeString(entries[i][1])))
+		}
+		b.WriteString("</ul>\n")
+		return os.WriteFile(filepath.Join(srcDir, "index.html"), []byte(archiveHTMLPage(name, b.String())), 0644)
+	}
+	b.WriteString("# " + escapeMarkdown(name) + "\n\n")
+	for i := len(entries) - 1; i >= 0; i-- {
+		b.WriteString(fmt.Sprintf("- [%s](%s) %s\n", entries[i][0][:len("2006-01-02")], entries[i][0], escapeMarkdown(entries[i][1])))
+	}
+	return os.WriteFile(filepath.Join(srcDir, "index.md"), []byte(b.String()), 0644)
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"html"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
 	"strconv"
@@ -20,9 +22,83 @@ import (
 type botReplies struct {
 	okAdded           string
 	helpMsg           string
+	helpSources       string
+	helpTargets       string
+	helpSubs          string
 	invalidRequest    string
 	noSuchGroup       string
 	noSuchChannel     string
+	noSuchFeed        string
+	noSuchAlbum       string
+	noSuchVideos      string
+	noSuchTopic       string
+	invalidFilter     string
+	filterList        string
+	noFilters         string
+	filtersCleared    string
+	invalidRewrite    string
+	rewriteList       string
+	noRewrites        string
+	invalidTemplate   string
+	templateSet       string
+	noTemplate        string
+	invalidDigest     string
+	digestSet         string
+	digestOff         string
+	digestHeader      string
+	invalidQuietHours string
+	noDestSubs        string
+	deliverySchedule  string
+	sendImmediately   string
+	quietHoursInfo    string
+	delayInfo         string
+	botTimezone       string
+	invalidModeration string
+	moderationOn      string
+	moderationOff     string
+	timeoutApprove    string
+	timeoutReject     string
+	reviewPost        string
+	approveButton     string
+	editButton        string
+	rejectButton      string
+	postApproved      string
+	postRejected      string
+	approvedOnTimeout string
+	rejectedOnTimeout string
+	postTextEdited    string
+	editPrompt        string
+	postDecided       string
+	invalidThreshold  string
+	thresholdVkOnly   string
+	thresholdSet      string
+	thresholdOff      string
+	thresholdLikes    string
+	thresholdReposts  string
+	thresholdViews    string
+	thresholdOr       string
+	invalidSettings   string
+	settingsList      string
+	nothingBlocked    string
+	jsonHookSecret    string
+	webhookUrl        string
+	emailTo           string
+	emailDigestTo     string
+	emailDigestTitle  string
+	emailSource       string
+	archiveTo         string
+	archiveRepost     string
+	archiveNoText     string
+	archiveAllPosts   string
+	rssDescription    string
+	vkWallTo          string
+	noSuchAccount     string
+	noSuchWebhook     string
+	httpDisabled      string
+	notConfigured     string
+	botAdminOnly      string
+	tgToTgOnly        string
+	vkWriteDenied     string
 	noSuchUser        string
 	groupPrivate      string
 	userPrivate       string
@@ -60,16 +136,152 @@ var i18n = map[string]botReplies{
 
 <code>/del [номер]</code> - удалить подписку с данным номером
 
+<code>/help sources</code> - альбомы, видео, обсуждения, поиск вк, RSS, Mastodon, каналы и вебхуки
+
+<code>/help targets</code> - Discord, Matrix, почта, JSON, архив, RSS и стена вк
+
+<code>/help subs</code> - фильтры, замены, шаблоны, дайджесты, расписание, модерация и настройки подписок
+
 Для подробностей, отправь ` + reqDetails,
+		helpSources: `<b>Другие источники</b>:
+
+<code>/add vk.com/album-123_456 @channel s</code> - новые фото альбома, <code>vk.com/albums-123</code> - всех альбомов группы
+
+<code>/add vk.com/videos-123 @channel s</code> - новые видео группы с названием и описанием
+
+<code>/add vk.com/topic-123_456 @channel s</code> - новые сообщения обсуждения с именем автора
+
+<code>/add search:"#хештег" @channel</code> - открытые посты вк с хештегом или словами, всегда со ссылкой на источник
+
+<code>/add https://site/feed.xml @channel s</code> - RSS или Atom лента
+
+<code>/add @user@mastodon.social @channel s</code> - аккаунт Mastodon, можно и ссылкой на профиль
+
+<code>/add @source @channel s</code> - посты своего канала в другой канал, бот должен быть админом в обоих
+
+<code>/add webhook @channel</code> - вебхук, адрес придет в лс, для POST запросов с JSON <code>{"text": "...", "media": ["https://..."], "link": "https://..."}</code>, <code>webhook:токен</code> подпишет на него еще канал`,
+		helpTargets: `<b>Другие площадки</b>:
+
+<code>/add vk.com/group discord:https://discord.com/api/webhooks/... s</code> - в Discord через вебхук канала
+
+<code>/add vk.com/group matrix:#room:matrix.org s</code> - в комнату Matrix, куда пригласили аккаунт бота. Только для админа бота.
+
+<code>/add vk.com/group email:user@example.com</code> - на почту, <code>email-digest:</code> - дайджестом за период. Только для админа бота.
+
+<code>/add vk.com/group json:https://example.com/hook</code> - POST с JSON, подпись HMAC-SHA256 в X-Crossposter-Signature. Только для админа бота.
+
+<code>/add vk.com/group archive</code> - в архив на диске бота в Markdown, <code>archive:html</code> - в HTML. Только для админа бота.
+
+<code>/add vk.com/group rss</code> - RSS лента по адресу /feed/group.xml на HTTP сервере бота
+
+<code>/add @source vk.com/group</code> - посты канала на стену сообщества вк вместе с правками. Только для админа бота с токеном сообщества.`,
+		helpSubs: `<b>Настройки подписок</b>:
+
+<code>/filter [номер] +слово -слово +#тег +/регулярка/ +:media -:text</code> - пропускать посты под любое правило с плюсом и ни под одно с минусом, <code>clear</code> - удалить правила
+
+<code>/rewrite [номер] "было" "стало"</code> - заменять текст или <code>/регулярку/</code> по порядку, <code>del 2</code> - удалить вторую замену, <code>clear</code> - все
+
+<code>/template [номер] {{.Text}} — {{link .SourceURL .SourceName}}</code> - шаблон Go text/template с полями .Text, .SourceName, .SourceURL, .Author, .Date, .Depth, <code>clear</code> - удалить
+
+<code>/digest [номер] daily 09:00 photos</code> - дайджест раз в день, <code>hourly</code> - раз в час, <code>weekly 09:00</code> - по понедельникам, <code>off</code> - выключить
+
+<code>/quiet @channel 23:00-08:00 Europe/Moscow</code> - тихие часы канала, посты выйдут после них, <code>off</code> - выключить
+
+<code>/delay @channel 30</code> - публиковать через 30 минут после выхода в источнике, <code>0</code> - сразу
+
+<code>/moderate [номер] me 24 approve</code> - посты сначала на проверку тебе или группе, через 24 часа без решения <code>approve</code> или <code>reject</code>, <code>off</code> - выключить
+
+<code>/threshold [номер] likes 100 views 5000 reposts 10 within 24</code> - только посты, набравшие порог за 24 часа, <code>off</code> - выключить
+
+<code>/settings [номер] owner on reposts off ads off pinned on donut on</code> - какие посты пересылать, <code>block vk.com/group</code> - без репостов из группы, <code>unblock</code> - вернуть
+
+Без параметров команды показывают текущие правила`,
 		okAdded:           "%s теперь подписан на %s, id подписки %d",
 		noSuchGroup:       "Группа %s не существует",
 		noSuchUser:        "Пользователь %s не существует",
 		noSuchChannel:     "Канал %s не существует",
+		noSuchFeed:        "Не удалось прочитать RSS или Atom ленту %s",
+		noSuchAlbum:       "Альбом %s не существует или закрыт",
+		noSuchVideos:      "Видеозаписи %s не существуют или закрыты",
+		noSuchTopic:       "Обсуждение %s не существует или закрыто",
+		invalidFilter:     "Не удалось разобрать правило %s. Правило начинается с + или -, за которым идет слово, #хештег, /регулярка/, :media или :text",
+		filterList:        "Фильтры подписки %d:\n%s",
+		noFilters:         "У подписки %d нет фильтров, приходят все посты",
+		filtersCleared:    "Фильтры подписки %d удалены",
+		invalidRewrite:    "Не удалось разобрать правило замены %s. Пиши <code>\"что заменить\" \"на что\"</code> или <code>/регулярка/ \"на что\"</code>",
+		rewriteList:       "Замены подписки %d:\n%s",
+		noRewrites:        "У подписки %d нет замен",
+		invalidTemplate:   "Ошибка в шаблоне: %s",
+		templateSet:       "Шаблон подписки %d:\n<pre>%s</pre>",
+		noTemplate:        "У подписки %d нет шаблона, посты отправляются как есть",
+		invalidDigest:     "Расписание дайджеста: <code>hourly</code>, <code>daily 09:00</code> или <code>weekly 09:00</code>, в конце можно добавить <code>photos</code>",
+		digestSet:         "Подписка %d приходит дайджестом: %s",
+		digestOff:         "Посты подписки %d приходят сразу",
+		digestHeader:      "Новых постов: %d",
+		invalidQuietHours: "Тихие часы указываются как <code>23:00-08:00 Europe/Moscow</code>, часовой пояс можно не указывать",
+		noDestSubs:        "На %s нет подписок",
+		deliverySchedule:  "%s: %s",
+		sendImmediately:   "посты публикуются сразу",
+		quietHoursInfo:    "тихие часы %s-%s (%s)",
+		delayInfo:         "задержка %d мин после публикации в источнике",
+		botTimezone:       "время бота",
+		invalidModeration: "Пиши <code>/moderate [номер] me</code> или <code>/moderate [номер] @chat 24 approve</code>, где 24 - через сколько часов пост без решения будет опубликован (approve) или отклонен (reject). Проверять посты можно в лс или в группе",
+		moderationOn:      "Посты подписки %d проходят модерацию в %s",
+		moderationOff:     "Посты подписки %d публикуются без модерации",
+		timeoutApprove:    "через %d ч без решения пост публикуется",
+		timeoutReject:     "через %d ч без решения пост отклоняется",
+		reviewPost:        "Пост подписки %d",
+		approveButton:     "Опубликовать",
+		editButton:        "Изменить текст",
+		rejectButton:      "Отклонить",
+		postApproved:      "Опубликован",
+		postRejected:      "Отклонен",
+		approvedOnTimeout: "Опубликован по таймауту",
+		rejectedOnTimeout: "Отклонен по таймауту",
+		postTextEdited:    "Текст изменен, новый вариант ниже",
+		editPrompt:        "Пришли новый текст поста ответом на это сообщение",
+		postDecided:       "Пост уже обработан",
+		invalidThreshold:  "Пиши <code>/threshold [номер] likes 100 reposts 10 views 5000 within 24</code>, любые из порогов в любом порядке. within - сколько часов после публикации ждать, от 1 до 168, по умолчанию 24",
+		thresholdVkOnly:   "Пороги можно задать только подпискам на стены вк и поиск",
+		thresholdSet:      "Посты подписки %d пересылаются, если за %d ч наберут %s",
+		thresholdOff:      "Посты подписки %d пересылаются без порога",
+		thresholdLikes:    "лайков ≥ %d",
+		thresholdReposts:  "репостов ≥ %d",
+		thresholdViews:    "просмотров ≥ %d",
+		thresholdOr:       " или ",
+		invalidSettings:   "Пиши <code>/settings [номер] reposts off ads on</code>. Настройки: <code>owner</code>, <code>reposts</code>, <code>ads</code>, <code>pinned</code>, <code>donut</code> со значением on или off, <code>block vk.com/group</code> и <code>unblock vk.com/group</code>",
+		settingsList: `Настройки подписки %d:
+owner %s - только посты от имени владельца стены
+reposts %s - репосты
+ads %s - рекламные посты
+pinned %s - закрепленные посты
+donut %s - посты для подписчиков VK Donut
+block - репосты из этих групп не пересылаются: %s`,
+		nothingBlocked:    "нет",
+		jsonHookSecret:    "Ключ подписи запросов на %s: <code>%s</code>\nОн показывается только один раз, сохрани его",
+		emailTo:           "почта %s",
+		emailDigestTo:     "дайджест на %s",
+		emailDigestTitle:  "Новые посты (%d)",
+		emailSource:       "Источник",
+		archiveTo:         "архив %s",
+		archiveRepost:     "Репост: %s",
+		archiveNoText:     "Без текста",
+		archiveAllPosts:   "← все посты",
+		rssDescription:    "Посты vk.com/%s",
+		vkWallTo:          "стена vk.com/%s",
+		webhookUrl:        "Адрес вебхука: <code>%s/webhook/%s</code>\nОн показывается только один раз, сохрани его. <code>/add webhook:%s @channel2</code> подпишет на вебхук еще канал",
+		noSuchAccount:     "Аккаунт %s не найден",
+		noSuchWebhook:     "Вебхука с таким токеном не существует",
+		httpDisabled:      "HTTP сервер бота выключен, вебхуки и ленты недоступны",
+		notConfigured:     "Админ бота не настроил эту площадку",
+		botAdminOnly:      "Эту площадку может подключать только админ бота",
+		tgToTgOnly:        "Каналы телеграма можно зеркалировать только в телеграм или на стену вк",
+		vkWriteDenied:     "Токен бота не позволяет публиковать на стене %s",
 		groupPrivate:      "Группа %s закрыта или заблокирована",
 		userPrivate:       "Страница пользователя %s заблокирована или скрыта",
 		queryFailed:       "Не удалось выполнить запрос из-за неизвестной ошибки",
 		noSuchSub:         "Нет подписки с таким id",
-		alreadySubscribed: "%s уже подписан на vk.com/%s",
+		alreadySubscribed: "%s уже подписан на %s",
 		delSuccess:        "Подписка %d успешно удалена",
 		noSubs:            "Список каналов пуст",
 		notAdmin:          "Как минимум одному из нас не хватает прав администратора этого чата. Они должны быть у нас обоих.",
@@ -91,6 +303,10 @@ type CrossposterConfig struct {
 	TgToken      string
 	DbName       string
 
+	// Token of the vk community where posts from telegram are published,
+	// leave empty if you don't need it.
+	VkWriteToken string
+
 	// Time in minutes between requests for updates to vk.
 	// It is an upper bound on how much time will pass between a post
 	// appearing on VK page and the bot picking it up and sending
@@ -119,6 +335,32 @@ type CrossposterConfig struct {
 	// If true, the bot will only respond to commands from users
 	// listed in BotAdmins
 	IsPrivate bool
+
+	// Address to listen for http requests, e.g. ":8080". The server
+	// receives webhooks, leave it empty to disable them.
+	HttpAddr string
+	// Url at which the http server is reachable from outside,
+	// used to show webhook addresses to users.
+	HttpBaseUrl string
+
+	// Matrix homeserver url and access token of the account which
+	// posts to matrix rooms. Leave empty to disable matrix.
+	MatrixHomeserver string
+	MatrixToken      string
+
+	// Smtp server as host:port, it must support STARTTLS if SmtpUser
+	// is set. Posts are sent from SmtpFrom address, email is disabled
+	// if SmtpAddr or SmtpFrom is empty.
+	SmtpAddr     string
+	SmtpUser     string
+	SmtpPassword string
+	SmtpFrom     string
+	// Hours between email digests, 24 if not set
+	EmailDigestPeriod int64
+
+	// Directory where archive destination writes posts,
+	// empty disables it
+	ArchiveDir string
 }
 
 type resolvedVkId struct {
@@ -141,14 +383,30 @@ type Crossposter struct {
 	dbSelectStmt     *sql.Stmt
 	dbDelStmt        *sql.Stmt
 	dbFindPubSubStmt *sql.Stmt
+	dbFindPubStmt    *sql.Stmt
+	dbFindSubStmt    *sql.Stmt
 	dbSelectAllStmt  *sql.Stmt
 	dbUpdateStmt     *sql.Stmt
 	dbReadPubsStmt   *sql.Stmt
 	dbReadSubsStmt   *sql.Stmt
 	addMsgRegex      *regexp.Regexp
 	delMsgRegex      *regexp.Regexp
+	filterMsgRegex   *regexp.Regexp
+	rewriteMsgRegex  *regexp.Regexp
+	templateMsgRegex *regexp.Regexp
+	digestMsgRegex   *regexp.Regexp
+	quietMsgRegex    *regexp.Regexp
+	delayMsgRegex    *regexp.Regexp
+	moderateMsgRegex *regexp.Regexp
+	thresholdRegex   *regexp.Regexp
+	settingsMsgRegex *regexp.Regexp
+	moderationMu     sync.Mutex
 	chDone           chan bool
+	stopJobs         chan struct{}
+	jobsWg           sync.WaitGroup
 	ps               pubsub
+	sources          []Source
+	sinks            []Sink
 	wg               sync.WaitGroup
 	batchSize        int
 	nPostsToFetch    int
@@ -156,6 +414,9 @@ type Crossposter struct {
 	stats            stats
 	botAdmins        []int64
 	isPrivate        bool
+	httpServer       *http.Server
+	httpMux          *http.ServeMux
+	httpBaseUrl      string
 }
 
 type pubSubData struct {
@@ -174,6 +435,15 @@ const (
 	reqStart       string = "/start"
 	reqStats       string = "/stats"
 	reqDetails     string = "/details"
+	reqFilter      string = "/filter"
+	reqRewrite     string = "/rewrite"
+	reqTemplate    string = "/template"
+	reqDigest      string = "/digest"
+	reqQuiet       string = "/quiet"
+	reqDelay       string = "/delay"
+	reqModerate    string = "/moderate"
+	reqThreshold   string = "/threshold"
+	reqSettings    string = "/settings"
 	kateUserAgent  string = "KateMobileAndroid/56 lite-460 (Android 4.4.2; SDK 19; x86; unknown Android SDK built for x86; en)"
 )
 
@@ -196,6 +466,27 @@ const (
 	errNoSuchSub
 	errAlreadySubscribed
 	errSubsLimitReached
+	errNoSuchFeed
+	errNoSuchAccount
+	errNoSuchWebhook
+	errHttpDisabled
+	errNotConfigured
+	errBotAdminOnly
+	errTgToTgOnly
+	errVkWriteDenied
+	errNoSuchAlbum
+	errNoSuchVideos
+	errNoSuchTopic
+	errInvalidFilter
+	errInvalidRewrite
+	errInvalidTemplate
+	errInvalidDigest
+	errInvalidQuietHours
+	errNoDestSubs
+	errInvalidModeration
+	errInvalidThreshold
+	errThresholdVkOnly
+	errInvalidSettings
 )
 
 const (
@@ -203,14 +494,31 @@ const (
 
 	regexAddSub = `^` + reqSubscribe +
 		`\s+` +
-		`(?:https?://)?` +
-		`(?:(?:m\.)?vk.com/(?P<vk>[a-zA-Z0-9_\.]+))\s+` +
-		`(?P<tg>(?:@[a-zA-Z][0-9a-zA-Z_]{4,})|(?:-?[0-9]+)|me)` +
+		`(?P<src>search:"[^"]+"|\S+)\s+` +
+		`(?P<dst>\S+)` +
 		`(?P<link_data>` +
 		`(\s+` + addCommandShowSource + `)|()` +
 		`)\s*$`
 
 	regexDelSub = `^` + reqUnsubscribe + `\s+([0-9]{1,4})$`
+
+	regexFilter = `^` + reqFilter + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexRewrite = `(?s)^` + reqRewrite + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexTemplate = `(?s)^` + reqTemplate + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexDigest = `^` + reqDigest + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexQuiet = `^` + reqQuiet + `\s+(\S+)(?:\s+(.*))?$`
+
+	regexDelay = `^` + reqDelay + `\s+(\S+)(?:\s+([0-9]{1,4}))?\s*$`
+
+	regexModerate = `^` + reqModerate + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexThreshold = `^` + reqThreshold + `\s+([0-9]{1,4})(?:\s+(.*))?$`
+
+	regexSettings = `^` + reqSettings + `\s+([0-9]{1,4})(?:\s+(.*))?$`
 )
 
 // it is dummy method, user errors are handled by HandleUserError
@@ -381,6 +689,48 @@ func handleUserError(err userError, c tele.Context) {
 		c.Send(fmt.Sprintf(i18n[lang].alreadySubscribed, err.tgUserOrGroup, err.vkUserOrGroup))
 	case errSubsLimitReached:
 		c.Send(fmt.Sprintf(i18n[lang].subsLimitReached, err.subsLimit))
+	case errNoSuchFeed:
+		c.Send(fmt.Sprintf(i18n[lang].noSuchFeed, err.vkUserOrGroup))
+	case errNoSuchAccount:
+		c.Send(fmt.Sprintf(i18n[lang].noSuchAccount, err.vkUserOrGroup))
+	case errNoSuchWebhook:
+		c.Send(i18n[lang].noSuchWebhook)
+	case errHttpDisabled:
+		c.Send(i18n[lang].httpDisabled)
+	case errNotConfigured:
+		c.Send(i18n[lang].notConfigured)
+	case errBotAdminOnly:
+		c.Send(i18n[lang].botAdminOnly)
+	case errTgToTgOnly:
+		c.Send(i18n[lang].tgToTgOnly)
+	case errVkWriteDenied:
+		c.Send(fmt.Sprintf(i18n[lang].vkWriteDenied, "vk.com/"+err.vkUserOrGroup))
+	case errNoSuchAlbum:
+		c.Send(fmt.Sprintf(i18n[lang].noSuchAlbum, "vk.com/"+err.vkUserOrGroup))
+	case errNoSuchVideos:
+		c.Send(fmt.Sprintf(i18n[lang].noSuchVideos, "vk.com/"+err.vkUserOrGroup))
+	case errNoSuchTopic:
+		c.Send(fmt.Sprintf(i18n[lang].noSuchTopic, "vk.com/"+err.vkUserOrGroup))
+	case errInvalidFilter:
+		c.Send(fmt.Sprintf(i18n[lang].invalidFilter, html.EscapeString(err.vkUserOrGroup)))
+	case errInvalidRewrite:
+		c.Send(fmt.Sprintf(i18n[lang].invalidRewrite, html.EscapeString(err.vkUserOrGroup)))
+	case errInvalidTemplate:
+		c.Send(fmt.Sprintf(i18n[lang].invalidTemplate, html.EscapeString(err.vkUserOrGroup)))
+	case errInvalidDigest:
+		c.Send(i18n[lang].invalidDigest)
+	case errInvalidQuietHours:
+		c.Send(i18n[lang].invalidQuietHours)
+	case errNoDestSubs:
+		c.Send(fmt.Sprintf(i18n[lang].noDestSubs, err.tgUserOrGroup))
+	case errInvalidModeration:
+		c.Send(i18n[lang].invalidModeration)
+	case errInvalidThreshold:
+		c.Send(i18n[lang].invalidThreshold)
+	case errThresholdVkOnly:
+		c.Send(i18n[lang].thresholdVkOnly)
+	case errInvalidSettings:
+		c.Send(i18n[lang].invalidSettings)
 	}
 }
 
@@ -421,7 +771,21 @@ func (cp *Crossposter) handleDel(c tele.Context) error {
 begin transaction;
 delete from pubSub where userID=? and pubSubID=?;
 delete from publishers where id not in (select pubID from pubSub);
+delete from feedEntries where pubID not in (select id from publishers);
 delete from subscribers where id not in (select subID from pubSub);
+delete from filters where pubSubID not in (select pubSubID from pubSub);
+delete from rewrites where pubSubID not in (select pubSubID from pubSub);
+delete from templates where pubSubID not in (select pubSubID from pubSub);
+delete from digests where pubSubID not in (select pubSubID from pubSub);
+delete from digestItems where pubSubID not in (select pubSubID from pubSub);
+delete from deliverySchedules where subID not in (select id from subscribers);
+delete from delayedPosts where subID not in (select id from subscribers);
+delete from moderation where pubSubID not in (select pubSubID from pubSub);
+delete from pendingPosts where pubSubID not in (select pubSubID from pubSub);
+delete from thresholds where pubSubID not in (select pubSubID from pubSub);
+delete from engagementCandidates where pubSubID not in (select pubSubID from pubSub);
+delete from postSettings where pubSubID not in (select pubSubID from pubSub);
+delete from blockedReposts where pubSubID not in (select pubSubID from pubSub);
 commit;`, c.Sender().ID, pubSubID, pubID)
 	if err != nil {
 		return err
@@ -434,6 +798,14 @@ commit;`, c.Sender().ID, pubSubID, pubID)
 
 func (cp *Crossposter) handleHelp(c tele.Context) error {
 	lang := getLang(c)
+	switch strings.TrimSpace(c.Message().Payload) {
+	case "sources":
+		return c.Send(i18n[lang].helpSources)
+	case "targets":
+		return c.Send(i18n[lang].helpTargets)
+	case "subs":
+		return c.Send(i18n[lang].helpSubs)
+	}
 	return c.Send(i18n[lang].helpMsg)
 }
 
@@ -450,59 +822,52 @@ func (cp *Crossposter) handleAdd(c tele.Context) error {
 	if len(matches) < 4 {
 		return userError{code: errInvalidRequest}
 	}
-	vkName, tgName, tgLinkData := matches[1], matches[2], matches[3]
+	srcAddr, dstAddr, tgLinkData := matches[1], matches[2], matches[3]
 	var flags uint64 = 0
 	if strings.Contains(tgLinkData, addCommandShowSource) {
 		flags |= flagAddLinkToPost
 	}
 
-	vkId, err := cp.resolveVkName(vkName)
+	src, srcKey, err := cp.resolveSource(srcAddr, c)
 	if err != nil {
 		return err
 	}
-	var tgId int64
+	srcName := src.Describe(srcKey)
 	userID := c.Sender().ID
 	lang := getLang(c)
-	if tgName == "me" {
-		tgId = userID
-		tgName = c.Sender().FirstName + c.Sender().LastName
-	} else {
-		tgId, err = cp.ResolveTgName(tgName)
-		if err != nil {
-			return userError{code: errNoSuchChannel, tgUserOrGroup: tgName}
-		}
-		if !cp.isUserAdmin(userID, tgId) {
-			return userError{code: errUserNotAdmin} // this return is a single thing that prevents users from messing each other's subscriptions
-		}
+	sink, dstKey, dstName, err := cp.resolveSink(dstAddr, c)
+	if err != nil {
+		return err
 	}
-
-	res := pubSubData{
-		userID:   userID,
-		pubID:    vkId,
-		subID:    tgId,
-		lastPost: 0,
+	// media of telegram posts is passed by file ids, which other sinks can't use
+	if src.Type() == sourceTelegram && sink.Type() != sinkTelegram && sink.Type() != sinkVkWall {
+		return userError{code: errTgToTgOnly}
 	}
 
 	queryRes, err := cp.db.Exec(`
 begin transaction;
-insert or ignore into publishers (id, lastPost) values(?,(select strftime('%s')));
-insert or ignore into subscribers (id, flags) values(?, ?);
-insert or rollback into pubSub (userID, pubID, subID, flags) values (?, ?, ?, ?);
+insert or ignore into publishers (type, key, lastPost) values(?, ?, ?);
+insert or ignore into subscribers (type, key, flags) values(?, ?, ?);
+insert or rollback into pubSub (userID, pubID, subID, flags) values (?,
+(select id from publishers where type=? and key=?),
+(select id from subscribers where type=? and key=?), ?);
 commit;`,
-		res.pubID, res.subID, flags, userID, res.pubID, res.subID, flags)
+		src.Type(), srcKey, src.InitialCursor(srcKey),
+		sink.Type(), dstKey, flags,
+		userID, src.Type(), srcKey, sink.Type(), dstKey, flags)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
 			return userError{code: errAlreadySubscribed,
-				tgUserOrGroup: tgName,
-				vkUserOrGroup: vkName,
+				tgUserOrGroup: dstName,
+				vkUserOrGroup: srcName,
 			}
 		}
 		if strings.Contains(err.Error(), "too many subscriptions") {
 			// log the event so that we know when users want more subscriptions
 			log.Printf("User %d exhausted subscriptions limit and wanted more\n", userID)
 			return userError{code: errSubsLimitReached,
-				tgUserOrGroup: tgName,
-				vkUserOrGroup: vkName,
+				tgUserOrGroup: dstName,
+				vkUserOrGroup: srcName,
 				subsLimit:     cp.subsLimit,
 			}
 		}
@@ -512,11 +877,19 @@ commit;`,
 	if err != nil {
 		log.Println("Error fetching LastInsertId!", err.Error())
 	}
-	cp.ps.subscribe(tgId, vkId, flags, func(ch <-chan update) {
-		cp.listenAndForward(ch, tgId)
-	})
-	c.Send(fmt.Sprintf(i18n[lang].okAdded, tgName, "vk.com/"+vkName, newID))
-	log.Printf("%d (%s) subscribed to vk.com/%s, pubsubID %d\n", tgId, tgName, vkName, newID)
+	var pubID, subID int64
+	pub := publisher{srcType: src.Type(), key: srcKey}
+	err = cp.dbFindPubStmt.QueryRow(pub.srcType, pub.key).Scan(&pubID, &pub.lastPost)
+	if err != nil {
+		return err
+	}
+	err = cp.dbFindSubStmt.QueryRow(sink.Type(), dstKey).Scan(&subID)
+	if err != nil {
+		return err
+	}
+	cp.ps.subscribe(subID, pubID, pub, flags, cp.newConsumer(sink.Type(), dstKey))
+	c.Send(fmt.Sprintf(i18n[lang].okAdded, dstName, srcName, newID))
+	log.Printf("%s %s (%s) subscribed to %s, pubsubID %d\n", sink.Type(), dstKey, dstName, srcName, newID)
 	return nil
 }
 func (cp *Crossposter) handleLs(c tele.Context) error {
@@ -529,25 +902,19 @@ func (cp *Crossposter) handleLs(c tele.Context) error {
 	patt := "[%d] %s => %s\n"
 	for rows.Next() {
 		var (
-			id  int64
-			pub int64
-			sub int64
+			id       int64
+			srcType  string
+			srcKey   string
+			sinkType string
+			dstKey   string
 		)
-		err := rows.Scan(&id, &pub, &sub)
+		err := rows.Scan(&id, &srcType, &srcKey, &sinkType, &dstKey)
 		if err != nil {
 			return err
 		}
-		vkName, err := cp.vkScreenNameById(pub)
-		if err != nil {
-			vkName = "[DELETED]"
-		} else {
-			vkName = "vk.com/" + vkName
-		}
-		tgName, err := cp.ResolveTgID(sub)
-		if err != nil {
-			tgName = "[DELETED]"
-		}
-		msg += fmt.Sprintf(patt, id, vkName, tgName)
+		srcName := cp.describePublisher(srcType, srcKey)
+		dstName := cp.describeSubscriber(sinkType, dstKey)
+		msg += fmt.Sprintf(patt, id, srcName, dstName)
 	}
 	if msg == "" {
 		return userError{code: errNoSubs}
@@ -558,8 +925,8 @@ func (cp *Crossposter) handleLs(c tele.Context) error {
 func (cp *Crossposter) handleStats(c tele.Context) error {
 
 	sql := `
-select * from (select count(*) from subscribers where id > 0),
-(select count(*) from subscribers where id < 0),
+select * from (select count(*) from subscribers where type='tg' and cast(key as integer) > 0),
+(select count(*) from subscribers where type='tg' and cast(key as integer) < 0),
 (select count(*) from publishers),
 (select count(*) from pubsub),
 (select count(*) from (select distinct userID from pubsub));`
@@ -606,19 +973,136 @@ end;`,
 		subsLimit)
 	return db.Exec(`
 create table if not exists publishers
-(id integer primary key, lastPost integer);
+(id integer primary key, type text not null default 'vk', key text, lastPost integer);
 create table if not exists subscribers
-(id integer primary key, flags integer);
+(id integer primary key, type text not null default 'tg', key text, flags integer);
 create table if not exists pubSub
 (pubSubID integer primary key, userID integer, pubID integer, subID integer, flags integer, unique(pubID, subID),
 foreign key (pubID) references publishers(id),
 foreign key (subID) references subscribers(id));
 create index if not exists pub on pubSub (pubID);
 create index if not exists sub on pubSub (subID);
-create index if not exists user on pubSub (userID);` +
+create index if not exists user on pubSub (userID);
+create table if not exists feedEntries
+(pubID integer, guid text, lastSeen integer, primary key (pubID, guid),
+foreign key (pubID) references publishers(id));
+create table if not exists jsonHookSecrets
+(url text primary key, secret text);
+create table if not exists jsonDeliveries
+(id integer primary key, url text, postLink text, status integer, attempts integer, error text, time integer);
+create index if not exists jsonDeliveriesTime on jsonDeliveries (time);
+create table if not exists vkWallPosts
+(srcLink text, ownerID integer, postID integer, attachments text, primary key (srcLink, ownerID));
+create table if not exists filters
+(pubSubID integer, rule text, primary key (pubSubID, rule),
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists rewrites
+(pubSubID integer, rule text,
+foreign key (pubSubID) references pubSub(pubSubID));
+create index if not exists rewritesPubSub on rewrites (pubSubID);
+create table if not exists templates
+(pubSubID integer primary key, template text,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists digests
+(pubSubID integer primary key, schedule text, lastSent integer,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists digestItems
+(id integer primary key, pubSubID integer, text text, link text, name text, photo text, tgFileID text, time integer,
+foreign key (pubSubID) references pubSub(pubSubID));
+create index if not exists digestItemsPubSub on digestItems (pubSubID);
+create table if not exists deliverySchedules
+(subID integer primary key, quietFrom integer, quietTo integer, timezone text, delay integer,
+foreign key (subID) references subscribers(id));
+create table if not exists delayedPosts
+(id integer primary key, subID integer, flags integer, post text, releaseAt integer,
+foreign key (subID) references subscribers(id));
+create index if not exists delayedPostsRelease on delayedPosts (releaseAt);
+create table if not exists moderation
+(pubSubID integer primary key, reviewChat integer, timeout integer, onTimeout text,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists pendingPosts
+(id integer primary key, pubSubID integer, post text, chatID integer, msgID integer, editMsgID integer, expireAt integer, onTimeout text,
+foreign key (pubSubID) references pubSub(pubSubID));
+create index if not exists pendingPostsReview on pendingPosts (chatID, editMsgID);
+create table if not exists thresholds
+(pubSubID integer primary key, likes integer, reposts integer, views integer, hours integer,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists engagementCandidates
+(id integer primary key, pubSubID integer, ownerID integer, postID integer, post text, expireAt integer,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists postSettings
+(pubSubID integer primary key, ownerOnly integer, reposts integer, ads integer, pinned integer, donut integer,
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists blockedReposts
+(pubSubID integer, rule text, primary key (pubSubID, rule),
+foreign key (pubSubID) references pubSub(pubSubID));
+create table if not exists emailDigestPosts
+(id integer primary key, address text, post text);
+create index if not exists emailDigestPostsAddress on emailDigestPosts (address);` +
 		trigger)
 }
 
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("select name from pragma_table_info('%s');", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// migrateDB brings databases created by older versions of the bot
+// to the current schema. Must be called after createTableIfNotExists.
+func migrateDB(db *sql.DB) error {
+	// publishers used to be vk walls identified by owner id
+	exists, err := hasColumn(db, "publishers", "type")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = db.Exec(`
+begin transaction;
+alter table publishers add column type text not null default 'vk';
+alter table publishers add column key text;
+update publishers set key=cast(id as text);
+commit;`)
+		if err != nil {
+			return fmt.Errorf("failed to add source type to publishers:\n%w", err)
+		}
+		log.Printf("Added source type and key to publishers table\n")
+	}
+	// and subscribers were telegram chats identified by chat id
+	exists, err = hasColumn(db, "subscribers", "type")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = db.Exec(`
+begin transaction;
+alter table subscribers add column type text not null default 'tg';
+alter table subscribers add column key text;
+update subscribers set key=cast(id as text);
+commit;`)
+		if err != nil {
+			return fmt.Errorf("failed to add sink type to subscribers:\n%w", err)
+		}
+		log.Printf("Added sink type and key to subscribers table\n")
+	}
+	_, err = db.Exec(`
+create unique index if not exists pubKey on publishers (type, key);
+create unique index if not exists subKey on subscribers (type, key);`)
+	return err
+}
+
 func (cp *Crossposter) updateTimeStamp(id int64, newTimeStamp int64) {
 	cp.ps.updateTimeStamp(id, newTimeStamp)
 	_, err := cp.dbUpdateStmt.Exec(newTimeStamp, id)
@@ -649,7 +1133,9 @@ func (cp *Crossposter) prepareStatements() error {
 	var err error
 
 	cp.dbSelectStmt, err =
-		cp.db.Prepare("select pubSubID, pubID, subID from pubSub where userID=?;")
+		cp.db.Prepare(`select pubSubID, p.type, p.key, s.type, s.key from pubSub
+join publishers p on pubSub.pubID = p.id
+join subscribers s on pubSub.subID = s.id where userID=?;`)
 
 	if err != nil {
 		return fmt.Errorf("failed to prepare insert statement:\n%w", err)
@@ -664,6 +1150,16 @@ func (cp *Crossposter) prepareStatements() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare find statement:\n%w", err)
 	}
+	cp.dbFindPubStmt, err =
+		cp.db.Prepare("select id, lastPost from publishers where type=? and key=?;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare find publisher statement:\n%w", err)
+	}
+	cp.dbFindSubStmt, err =
+		cp.db.Prepare("select id from subscribers where type=? and key=?;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare find subscriber statement:\n%w", err)
+	}
 	cp.dbSelectAllStmt, err =
 		cp.db.Prepare("select * from pubSub;")
 	if err != nil {
@@ -674,11 +1170,11 @@ func (cp *Crossposter) prepareStatements() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare update statement:\n%w", err)
 	}
-	cp.dbReadPubsStmt, err = cp.db.Prepare("select id, lastPost from publishers;")
+	cp.dbReadPubsStmt, err = cp.db.Prepare("select id, type, key, lastPost from publishers;")
 	if err != nil {
 		return fmt.Errorf("failed to prepare read statement:\n%w", err)
 	}
-	cp.dbReadSubsStmt, err = cp.db.Prepare("select id from subscribers;")
+	cp.dbReadSubsStmt, err = cp.db.Prepare("select id, type, key from subscribers;")
 	if err != nil {
 		return fmt.Errorf("failed to prepare read statement:\n%w", err)
 	}
@@ -694,6 +1190,10 @@ func (cp *Crossposter) initDB() error {
 	if err != nil {
 		return fmt.Errorf("initDB: failed to createTableIfNotExists:\n%w", err)
 	}
+	err = migrateDB(cp.db)
+	if err != nil {
+		return fmt.Errorf("initDB: failed to migrate:\n%w", err)
+	}
 	err = cp.prepareStatements()
 	if err != nil {
 		return err
@@ -705,27 +1205,29 @@ func (cp *Crossposter) readDB() error {
 	if err != nil {
 		return err
 	}
-	var id, lastPost int64
+	var id int64
 	for rows.Next() {
-		err = rows.Scan(&id, &lastPost)
+		pub := publisher{subs: make(subscribersMap)}
+		err = rows.Scan(&id, &pub.srcType, &pub.key, &pub.lastPost)
 		if err != nil {
 			return err
 		}
-		cp.ps.addPublisher(id, vkSource{lastPost: lastPost, subs: make(subscribersMap)})
+		cp.ps.addPublisher(id, pub)
 	}
 	rows, err = cp.dbReadSubsStmt.Query()
 	if err != nil {
 		return err
 	}
 	for rows.Next() {
-		err = rows.Scan(&id)
+		var sinkType, key string
+		err = rows.Scan(&id, &sinkType, &key)
 		if err != nil {
 			return err
 		}
-		id := id
-		cp.ps.addSubscriber(id, func(ch <-chan update) {
-			cp.listenAndForward(ch, id)
-		})
+		if cp.sink(sinkType) == nil {
+			log.Printf("No sink for type %s, subscriber %s won't receive posts\n", sinkType, key)
+		}
+		cp.ps.addSubscriber(id, cp.newConsumer(sinkType, key))
 	}
 	rows, err = cp.dbSelectAllStmt.Query()
 	if err != nil {
@@ -741,9 +1243,99 @@ func (cp *Crossposter) readDB() error {
 		}
 		cp.ps.subscribeSimple(ps.subID, ps.pubID, ps.flags)
 	}
+	if err = cp.readPostSettings(); err != nil {
+		return err
+	}
+	if err = cp.readFilters(); err != nil {
+		return err
+	}
+	if err = cp.readRewrites(); err != nil {
+		return err
+	}
+	if err = cp.readTemplates(); err != nil {
+		return err
+	}
+	if err = cp.readDigests(); err != nil {
+		return err
+	}
+	if err = cp.readModeration(); err != nil {
+		return err
+	}
+	if err = cp.readThresholds(); err != nil {
+		return err
+	}
+	return cp.readDeliverySchedules()
+}
+
+// Rules of subscriptions such as filters are stored as rows of
+// (pubSubID, rule) in their own tables, in the order they were added.
+
+func (cp *Crossposter) loadSubscriptionRules(table string, pubSubID int64) ([]string, error) {
+	rows, err := cp.db.Query(fmt.Sprintf("select rule from %s where pubSubID=? order by rowid;", table), pubSubID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []string{}
+	for rows.Next() {
+		var rule string
+		if err = rows.Scan(&rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// readSubscriptionRules passes rules of every subscription which has them to apply
+func (cp *Crossposter) readSubscriptionRules(table string, apply func(pubSubID int64, pubID int64, subID int64, rules []string)) error {
+	rows, err := cp.db.Query(fmt.Sprintf(`select pubSub.pubSubID, pubSub.pubID, pubSub.subID, %[1]s.rule from %[1]s
+join pubSub on %[1]s.pubSubID = pubSub.pubSubID order by %[1]s.rowid;`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type subRef struct{ pubID, subID int64 }
+	rules := make(map[int64][]string)
+	refs := make(map[int64]subRef)
+	for rows.Next() {
+		var pubSubID int64
+		var ref subRef
+		var rule string
+		if err = rows.Scan(&pubSubID, &ref.pubID, &ref.subID, &rule); err != nil {
+			return err
+		}
+		rules[pubSubID] = append(rules[pubSubID], rule)
+		refs[pubSubID] = ref
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for pubSubID, ref := range refs {
+		apply(pubSubID, ref.pubID, ref.subID, rules[pubSubID])
+	}
 	return nil
 }
 
+// findOwnedPubSub parses command of the form /command <pubSubID> <rest> and
+// returns the subscription if it belongs to the sender, with the rest of the command
+func (cp *Crossposter) findOwnedPubSub(c tele.Context, re *regexp.Regexp) (int64, int64, int64, string, error) {
+	matches := re.FindStringSubmatch(c.Text())
+	if len(matches) != 3 {
+		return 0, 0, 0, "", userError{code: errInvalidRequest}
+	}
+	pubSubID, _ := strconv.ParseInt(matches[1], 10, 64)
+	var pubID, subID int64
+	err := cp.dbFindPubSubStmt.QueryRow(pubSubID, c.Sender().ID).Scan(&pubID, &subID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, 0, "", userError{code: errNoSuchSub}
+	}
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	return pubSubID, pubID, subID, matches[2], nil
+}
+
 func (cp *Crossposter) isUserBotAdmin(id int64) bool {
 	for _, adminID := range cp.botAdmins {
 		if id == adminID {
@@ -781,6 +1373,20 @@ func (cp *Crossposter) setHandlers() {
 	cp.tgBot.Handle(reqUnsubscribe, regularHandler((*Crossposter).handleDel))
 	cp.tgBot.Handle(reqStart, regularHandler((*Crossposter).handleHelp))
 	cp.tgBot.Handle(reqDetails, regularHandler((*Crossposter).handleDetails))
+	cp.tgBot.Handle(reqFilter, regularHandler((*Crossposter).handleFilter))
+	cp.tgBot.Handle(reqRewrite, regularHandler((*Crossposter).handleRewrite))
+	cp.tgBot.Handle(reqTemplate, regularHandler((*Crossposter).handleTemplate))
+	cp.tgBot.Handle(reqDigest, regularHandler((*Crossposter).handleDigest))
+	cp.tgBot.Handle(reqQuiet, regularHandler((*Crossposter).handleQuiet))
+	cp.tgBot.Handle(reqDelay, regularHandler((*Crossposter).handleDelay))
+	cp.tgBot.Handle(reqModerate, regularHandler((*Crossposter).handleModerate))
+	cp.tgBot.Handle(reqThreshold, regularHandler((*Crossposter).handleThreshold))
+	cp.tgBot.Handle(reqSettings, regularHandler((*Crossposter).handleSettings))
+	cp.tgBot.Handle(&tele.Btn{Unique: uniqueApprove}, regularHandler((*Crossposter).handleApprove))
+	cp.tgBot.Handle(&tele.Btn{Unique: uniqueEdit}, regularHandler((*Crossposter).handleEditButton))
+	cp.tgBot.Handle(&tele.Btn{Unique: uniqueReject}, regularHandler((*Crossposter).handleReject))
+	// replies to the prompt for a new text of a post in review
+	cp.tgBot.Handle(tele.OnText, regularHandler((*Crossposter).handleReviewReply))
 
 	cp.tgBot.Handle(reqStats, priveledgedHandler((*Crossposter).handleStats))
 }
@@ -831,6 +1437,40 @@ func NewCrossposter(cfg CrossposterConfig) (*Crossposter, error) {
 	cp.setHandlers()
 	cp.addMsgRegex = regexp.MustCompile(regexAddSub)
 	cp.delMsgRegex = regexp.MustCompile(regexDelSub)
+	cp.filterMsgRegex = regexp.MustCompile(regexFilter)
+	cp.rewriteMsgRegex = regexp.MustCompile(regexRewrite)
+	cp.templateMsgRegex = regexp.MustCompile(regexTemplate)
+	cp.digestMsgRegex = regexp.MustCompile(regexDigest)
+	cp.quietMsgRegex = regexp.MustCompile(regexQuiet)
+	cp.delayMsgRegex = regexp.MustCompile(regexDelay)
+	cp.moderateMsgRegex = regexp.MustCompile(regexModerate)
+	cp.thresholdRegex = regexp.MustCompile(regexThreshold)
+	cp.settingsMsgRegex = regexp.MustCompile(regexSettings)
+
+	cp.initHttpServer(cfg)
+	cp.sources = []Source{
+		// album addresses of users look like screen names, so they go first
+		&vkAlbumSource{cp},
+		&vkVideoSource{cp},
+		&vkBoardSource{cp},
+		&vkSearchSource{cp},
+		&vkWallSource{cp},
+		newMastodonSource(cp),
+		newWebhookSource(cp),
+		newFeedSource(cp),
+		newTgChannelSource(cp),
+	}
+	cp.sinks = []Sink{
+		&tgSink{cp, cp.tgBot},
+		newDiscordSink(),
+		newMatrixSink(cp, cfg),
+		newEmailSink(cp, cfg, false),
+		newEmailSink(cp, cfg, true),
+		newJsonSink(cp),
+		newArchiveSink(cp, cfg),
+		newRssSink(cp),
+		newVkWallSink(cp, cfg),
+	}
 
 	cp.dbName = cfg.DbName
 	err = cp.initDB()
@@ -839,8 +1479,13 @@ func NewCrossposter(cfg CrossposterConfig) (*Crossposter, error) {
 	}
 
 	cp.chDone = make(chan bool)
-	cp.ps.pubToSub = make(map[int64]vkSource)
+	cp.stopJobs = make(chan struct{})
+	cp.ps.pubToSub = make(map[int64]publisher)
 	cp.ps.subscribers = make(map[int64]subscriber)
+	cp.ps.collect = cp.collectDigest
+	cp.ps.hold = cp.holdPosts
+	cp.ps.moderate = cp.moderatePosts
+	cp.ps.watch = cp.watchPosts
 	err = cp.readDB()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read db:\n%w", err)
@@ -848,9 +1493,39 @@ func NewCrossposter(cfg CrossposterConfig) (*Crossposter, error) {
 	cp.vkIdCache = NewCacheMap[int64, resolvedVkId](1000)
 	return cp, nil
 }
+
+// startScheduledJobs sends digests and delayed posts when they're due,
+// decides on posts which waited for review for too long and runs jobs of sinks.
+// It runs until stopJobs is closed.
+func (cp *Crossposter) startScheduledJobs() {
+	defer cp.jobsWg.Done()
+	// reviews which failed to send before restart
+	cp.sendReviews()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.stopJobs:
+			return
+		case now := <-ticker.C:
+			cp.sendDigests()
+			cp.releaseDelayed()
+			cp.expireReviews()
+			for _, s := range cp.sinks {
+				if j, ok := s.(scheduledSink); ok {
+					j.runJobs(now)
+				}
+			}
+		}
+	}
+}
+
 func (cp *Crossposter) Start() {
 	cp.stats.startTime = time.Now().Unix()
 	go cp.startCrossposting()
+	cp.jobsWg.Add(1)
+	go cp.startScheduledJobs()
+	go cp.startHttpServer()
 	cp.tgBot.Start()
 }
 func (cp *Crossposter) Stop() {
@@ -858,10 +1533,19 @@ func (cp *Crossposter) Stop() {
 	cp.tgBot.Stop()
 	log.Printf("Stopped Telegram bot\n")
 	cp.chDone <- true
+	close(cp.stopJobs)
+	cp.jobsWg.Wait()
+	log.Printf("Stopped scheduled jobs\n")
+	cp.stopHttpServer()
 	cp.ps.stopPubSub()
 	log.Printf("Stopped PubSub, waiting for workers to finish\n")
 	cp.wg.Wait()
 	log.Printf("All PubSub workers finished\n")
+	for _, s := range cp.sinks {
+		if f, ok := s.(flusher); ok {
+			f.Flush()
+		}
+	}
 	cp.db.Close()
 	log.Printf("Closed db connection\n")
 	log.Printf("Finished\n")
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// telegram doesn't send messages longer than 4096 characters,
+// bytes are counted to be on the safe side
+const tgMaxMsgLen = 4096
+
+func TestHelpFitsInMessage(t *testing.T) {
+	for lang, replies := range i18n {
+		for name, msg := range map[string]string{
+			"helpMsg":     replies.helpMsg,
+			"helpSources": replies.helpSources,
+			"helpTargets": replies.helpTargets,
+			"helpSubs":    replies.helpSubs,
+		} {
+			if msg == "" {
+				t.Errorf("%s %s is empty", lang, name)
+			}
+			if len(msg) > tgMaxMsgLen {
+				t.Errorf("%s %s is %d bytes long, telegram allows %d", lang, name, len(msg), tgMaxMsgLen)
+			}
+		}
+	}
+}
+
+// every reply has to be translated, telegram doesn't send empty messages
+func TestRepliesAreNotEmpty(t *testing.T) {
+	for lang, replies := range i18n {
+		v := reflect.ValueOf(replies)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).String() == "" {
+				t.Errorf("%s %s is empty", lang, v.Type().Field(i).Name)
+			}
+		}
+	}
+}
@@ -1,14 +1,11 @@
 package main
 
-// this part uses vk api execute method to get batched updates for vk
-// and dispatch them to subscribers via channels
+// this part turns vk posts into preparedPost and forwards
+// them to subscribers received via channels
 
 import (
 	"fmt"
-	"html"
 	"log"
-	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,7 +13,6 @@ import (
 
 	vkApi "github.com/SevereCloud/vksdk/v2/api"
 	vkObject "github.com/SevereCloud/vksdk/v2/object"
-	tele "gopkg.in/telebot.v3"
 )
 
 const (
@@ -28,8 +24,10 @@ const (
 )
 
 type vkReqData struct {
-	id       int64
+	id       int64 // publisher id, returned back in vkReqResult
+	owner    int64
 	lastPost int64
+	ads      bool // posts marked as ads are fetched too
 }
 type vkReqResult struct {
 	Id       int64                   `json:"id"`
@@ -43,9 +41,8 @@ type vkAudio struct {
 }
 
 type postLink struct {
-	formattedPostLink string
-	rawPostLink       string
-	postLinkTextLen   int
+	rawPostLink string
+	name        string // name of the source, shown as link text
 }
 
 const (
@@ -55,7 +52,17 @@ const (
 	nMediaTypes
 )
 
-type preparedMedia [nMediaTypes][]tele.Inputtable
+// mediaItem is a file attached to a post. Sinks download it
+// by url by themselves or pass the url to their api.
+type mediaItem struct {
+	url       string
+	isVideo   bool   // only in mediaPhotoVideo
+	title     string // audio title or document file name
+	performer string
+	tgFileID  string // set instead of url for media from telegram
+}
+
+type preparedMedia [nMediaTypes][]mediaItem
 type preparedAttachments struct {
 	media preparedMedia
 	links []string
@@ -78,7 +85,15 @@ type preparedPost struct {
 	att         preparedAttachments
 	ownerID     int
 	ID          int
+	date        int64 // unix time of publication, 0 if unknown
+	edited      bool  // post is an edit of an already published one
+	alwaysLink  bool  // link to the post is added regardless of subscription flags
 	text        string
+	author      string // name of the person who wrote the post if it's known
+	fromID      int    // vk id of the author, 0 if unknown
+	ad          bool   // marked as ads, they're dropped by default
+	pinned      bool   // pinned on the wall when it was fetched
+	donut       bool   // for VK Donut subscribers only
 	copyHistory []preparedPost
 	Link        postLink
 }
@@ -130,17 +145,17 @@ func makeObjects(batch []vkReqData) string {
 	if len(batch) == 0 {
 		return ""
 	}
-	pat := `{"id":%d, "lastPost": %d}`
-	res := fmt.Sprintf(pat, batch[0].id, batch[0].lastPost)
+	pat := `{"id":%d, "owner":%d, "lastPost": %d, "ads": %t}`
+	res := fmt.Sprintf(pat, batch[0].id, batch[0].owner, batch[0].lastPost, batch[0].ads)
 	for _, cur := range batch[1:] {
-		res += `,` + fmt.Sprintf(pat, cur.id, cur.lastPost)
+		res += `,` + fmt.Sprintf(pat, cur.id, cur.owner, cur.lastPost, cur.ads)
 	}
 	return res
 }
 
-func (cp *Crossposter) getAudio(audioIds []string) []tele.Inputtable {
+func (cp *Crossposter) getAudio(audioIds []string) []mediaItem {
 
-	res := []tele.Inputtable{}
+	res := []mediaItem{}
 	if len(audioIds) == 0 {
 		return res
 	}
@@ -155,15 +170,10 @@ func (cp *Crossposter) getAudio(audioIds []string) []tele.Inputtable {
 
 	for i, a := range vkRes {
 		if a.Url != "" {
-			r, err := http.Get(a.Url)
-			if err != nil {
-				log.Printf("Failed to get audio from url %s\n%s\n", a.Url, err.Error())
-				continue
-			}
-			res = append(res, &tele.Audio{
-				File:      tele.FromReader(r.Body),
-				Title:     a.Title,
-				Performer: a.Performer,
+			res = append(res, mediaItem{
+				url:       a.Url,
+				title:     a.Title,
+				performer: a.Performer,
 			})
 		} else {
 			log.Printf("Failed to get audio %s\n", audioIds[i])
@@ -172,7 +182,7 @@ func (cp *Crossposter) getAudio(audioIds []string) []tele.Inputtable {
 	}
 	return res
 }
-func (cp *Crossposter) getVideo(videoIds []string) ([]tele.Inputtable, []string) {
+func (cp *Crossposter) getVideo(videoIds []string) ([]mediaItem, []string) {
 	vkRes, err := cp.vkAudio.VideoGet(map[string]interface{}{
 		"videos": strings.Join(videoIds, ","),
 	})
@@ -181,38 +191,38 @@ func (cp *Crossposter) getVideo(videoIds []string) ([]tele.Inputtable, []string)
 		log.Printf("Failed to get video:\n%s\n", err.Error())
 		return nil, nil
 	}
-	res := []tele.Inputtable{}
+	res := []mediaItem{}
 	resLinks := []string{}
 	for i := range vkRes.Items {
-		v := &vkRes.Items[i]
-		if v.Platform == "YouTube" {
-			resLinks = append(resLinks, convertYoutubeUrl(v.Player))
-			continue
-		}
-		if v.Duration < maxVidDuration && (v.Platform == "vk" || v.Platform == "") {
-
-			if url := findVideoURL(v); url == "" {
-				log.Printf("Couldn't find url for video %d_%d\n", v.OwnerID, v.ID)
-			} else {
-				req, _ := http.NewRequest("GET", url, nil)
-				req.Header.Set("User-Agent", kateUserAgent)
-				r, err := cp.vkAudio.Client.Get(url)
-				if err != nil {
-					log.Printf("Failed to get video from url\n%s\n", err.Error())
-					continue
-				}
-				res = append(res, &tele.Video{
-					File: tele.FromReader(r.Body),
-				})
-				time.Sleep(time.Millisecond * 200)
-				continue
-			}
+		if m, link := prepareVideo(&vkRes.Items[i]); link != "" {
+			resLinks = append(resLinks, link)
+		} else {
+			res = append(res, m)
 		}
-		resLinks = append(resLinks, fmt.Sprintf("vk.com/video%d_%d", v.OwnerID, v.ID))
 	}
 	return res, resLinks
 }
 
+// prepareVideo returns the video as media if it can be sent as a file,
+// or a link to it otherwise
+func prepareVideo(v *vkObject.VideoVideo) (mediaItem, string) {
+	if v.Platform == "YouTube" {
+		return mediaItem{}, convertYoutubeUrl(v.Player)
+	}
+	if v.Duration < maxVidDuration && (v.Platform == "vk" || v.Platform == "") {
+
+		if url := findVideoURL(v); url == "" {
+			log.Printf("Couldn't find url for video %d_%d\n", v.OwnerID, v.ID)
+		} else {
+			return mediaItem{
+				url:     url,
+				isVideo: true,
+			}, ""
+		}
+	}
+	return mediaItem{}, fmt.Sprintf("vk.com/video%d_%d", v.OwnerID, v.ID)
+}
+
 func (cp *Crossposter) getAttachments(post *vkObject.WallWallpost) preparedAttachments {
 
 	// because telegram album contains either photo/video or audio or documents, we separate them
@@ -224,12 +234,12 @@ func (cp *Crossposter) getAttachments(post *vkObject.WallWallpost) preparedAttac
 		case "photo":
 			url := getPhotoUrl(att.Photo)
 			res.media[mediaPhotoVideo] = append(res.media[mediaPhotoVideo],
-				&tele.Photo{File: tele.FromURL(url)})
+				mediaItem{url: url})
 		case "audio":
 			audioIds = append(audioIds, strconv.Itoa(att.Audio.OwnerID)+"_"+strconv.Itoa(att.Audio.ID))
 		case "doc":
 			res.media[mediaDoc] = append(res.media[mediaDoc],
-				&tele.Document{File: tele.FromURL(att.Doc.URL)})
+				mediaItem{url: att.Doc.URL, title: att.Doc.Title})
 		case "video":
 			vID := strconv.Itoa(att.Video.OwnerID) + "_" + strconv.Itoa(att.Video.ID)
 			if att.Video.AccessKey != "" {
@@ -256,120 +266,32 @@ func (cp *Crossposter) getAttachments(post *vkObject.WallWallpost) preparedAttac
 	return res
 }
 
-func (cp *Crossposter) sendText(text string, link postLink, chat int64, opts tele.SendOptions) *tele.Message {
-	text = strings.Trim(text, " \t\n")
-	if len(text) == 0 {
-		return nil
-	}
-	if len(text) > 0 && link.postLinkTextLen > 0 {
-		text = text + "\n\n"
-	}
-
-	var firstMsg *tele.Message
-	appendedLink := false
-	maxMsgSize := 4096
-	for len(text) > 0 || (len(link.formattedPostLink) > 0 && !appendedLink) {
-		splitIndex, msgLen := findIndexToSplit(text, maxMsgSize)
-
-		msgText := inlineLinkRegex.ReplaceAllString(
-			html.EscapeString(text[0:splitIndex]),
-			"<a href='https://vk.com/$1$2'>$3</a>",
-		)
-		// if text fits in one message, check if it will fit with link too
-		if splitIndex == len(text) && msgLen+link.postLinkTextLen <= maxMsgSize {
-			msgText = msgText + link.formattedPostLink
-			appendedLink = true
-		}
-
-		newMsg, err := cp.tgBot.Send(tele.ChatID(chat), msgText, &opts)
-		time.Sleep(time.Second * 4)
-		if err != nil {
-			log.Printf("Failed to send text message for post %s:\n%s\n", link.rawPostLink, err.Error())
-			return nil
-		}
-
-		if firstMsg == nil {
-			firstMsg = newMsg
-		}
-		opts.ReplyTo = newMsg
-		text = strings.TrimLeft(text[splitIndex:], " \t\n")
+func deliverPost(post *preparedPost, sink Sink, key string, flags uint64, replyTo msgRef) msgRef {
+	ref, err := sink.Deliver(key, post, flags, replyTo)
+	if err != nil {
+		log.Printf("Failed to deliver post %s to %s %s:\n%s\n", post.Link.rawPostLink, sink.Type(), key, err.Error())
 	}
-	return firstMsg
+	return ref
 }
-func (cp *Crossposter) sendWithAttachments(text string, link postLink, id int64, att preparedAttachments, opts tele.SendOptions) *tele.Message {
-
-	if len(att.links) != 0 {
-		text = text + "\n" + strings.Join(att.links, "\n")
-	}
 
-	maxMsgSize := 1024
-	_, msgSize := findIndexToSplit(text, 999999) // count rendered characters in a text
-	if link.postLinkTextLen > 0 {
-		if msgSize > 0 {
-			msgSize += 2 // two newlines
-			text = text + "\n\n"
-		}
-		msgSize += link.postLinkTextLen
+func (cp *Crossposter) forwardPost(post *preparedPost, sink Sink, key string, flags uint64) {
+	if post.alwaysLink {
+		flags |= flagAddLinkToPost
 	}
-	var firstMsg *tele.Message = nil
-	if msgSize > maxMsgSize || att.media.Empty() {
-		firstMsg = cp.sendText(text, link, id, opts)
-		text = text[:0]
-		opts.ReplyTo = firstMsg
-	} else {
-		text = inlineLinkRegex.ReplaceAllString(
-			html.EscapeString(text),
-			"<a href='https://vk.com/$1$2'>$3</a>") +
-			link.formattedPostLink
-	}
-	for mediaType := range att.media {
-		if len(att.media[mediaType]) == 0 {
-			continue
-		}
-		msg, err := cp.tgBot.SendAlbum(tele.ChatID(id), att.media[mediaType], text, &opts)
-		// simplest way to not exceed 20 messages per minute
-		time.Sleep(time.Second * 4 * time.Duration(len(att.media[mediaType])))
-		if err != nil {
-			log.Printf("Failed to send attachment for post %s:\n%s\n", link.rawPostLink, err.Error())
-			if len(text) > 0 {
-				// if we failed to send text, give up and return,
-				// otherwise continue trying to send other attachments.
-				return nil
+	if post.edited {
+		if es, ok := sink.(editingSink); ok {
+			if err := es.Edit(key, post, flags); err != nil {
+				log.Printf("Failed to edit post %s in %s %s:\n%s\n", post.Link.rawPostLink, sink.Type(), key, err.Error())
 			}
 		}
-
-		// we post attachments as a reply to initial message, while the initial message may be a reply
-		// to another message passed in opts in case of repost chains
-		if firstMsg == nil && len(msg) > 0 {
-			firstMsg = &msg[0]
-			opts.ReplyTo = firstMsg
-		}
-		text = text[:0]
-
+		return
 	}
-	return firstMsg
-}
-
-func (cp *Crossposter) forwardSinglePost(post *preparedPost, flags uint64, chatID int64, opts tele.SendOptions) *tele.Message {
-
-	link := post.Link
-	if flags&flagAddLinkToPost == 0 {
-		link.formattedPostLink = ""
-		link.postLinkTextLen = 0
-	}
-
-	if post.att.Empty() {
-		return cp.sendText(post.text, link, chatID, opts)
-	}
-	return cp.sendWithAttachments(post.text, link, chatID, post.att, opts)
-}
-
-func (cp *Crossposter) forwardPost(post *preparedPost, chatID int64, flags uint64) {
-
-	opts := tele.SendOptions{
-		ParseMode: "HTML",
+	if _, ok := sink.(chainSink); ok {
+		deliverPost(post, sink, key, flags, "")
+		return
 	}
 
+	var replyTo msgRef
 	for i := range post.copyHistory {
 		flags := flags
 		// if we have reposts from external pages, add reference to source regardless of setting
@@ -377,16 +299,20 @@ func (cp *Crossposter) forwardPost(post *preparedPost, chatID int64, flags uint6
 			flags |= flagAddLinkToPost
 		}
 
-		opts.ReplyTo = cp.forwardSinglePost(&post.copyHistory[i], flags, chatID, opts)
+		replyTo = deliverPost(&post.copyHistory[i], sink, key, flags, replyTo)
 	}
-	cp.forwardSinglePost(post, flags, chatID, opts)
+	deliverPost(post, sink, key, flags, replyTo)
 
 }
-func (cp *Crossposter) listenAndForward(upd <-chan update, chatID int64) {
+func (cp *Crossposter) listenAndForward(upd <-chan update, sink Sink, key string) {
 	cp.wg.Add(1)
 	for update := range upd {
+		if sink == nil {
+			log.Printf("No sink to deliver %d posts to %s\n", len(update.posts), key)
+			continue
+		}
 		for i := range update.posts {
-			cp.forwardPost(&update.posts[i], chatID, uint64(update.flags))
+			cp.forwardPost(&update.posts[i], sink, key, uint64(update.flags))
 		}
 	}
 	cp.wg.Done()
@@ -395,102 +321,41 @@ func (cp *Crossposter) listenAndForward(upd <-chan update, chatID int64) {
 func (cp *Crossposter) makeLinkToPost(post *vkObject.WallWallpost) postLink {
 
 	ownerData, _ := cp.resolveVkId(int64(post.OwnerID))
-	postLinkText := ownerData.Name
-	rawPostLink := fmt.Sprintf("https://vk.com/wall%d_%d", post.OwnerID, post.ID)
-	formattedPostLink := fmt.Sprintf("[<a href = '%s'>%s</a>]", rawPostLink, postLinkText)
-	postLinkLen := len([]rune(postLinkText)) + 2
-
 	return postLink{
-		formattedPostLink,
-		rawPostLink,
-		postLinkLen,
+		rawPostLink: fmt.Sprintf("https://vk.com/wall%d_%d", post.OwnerID, post.ID),
+		name:        ownerData.Name,
 	}
 }
 
 func (cp *Crossposter) preparePosts(posts []vkObject.WallWallpost, HandleReposts bool) []preparedPost {
 	res := make([]preparedPost, 0, len(posts))
 	for i := len(posts) - 1; i >= 0; i-- {
-		// We only skip ads if they're not intentionally reposted.
-		// For reposts HandleReposts is false, so the ads will be
-		// handled as ordinary posts.
-		if bool(posts[i].MarkedAsAds) && HandleReposts {
-			continue
-		}
-
 		var copyHistory []preparedPost = nil
 		if HandleReposts {
 			copyHistory = cp.preparePosts(posts[i].CopyHistory, false)
 		}
-		res = append(res, preparedPost{
+		post := preparedPost{
 			att:         cp.getAttachments(&posts[i]),
 			text:        posts[i].Text,
 			copyHistory: copyHistory,
 			ID:          posts[i].ID,
+			date:        int64(posts[i].Date),
 			ownerID:     posts[i].OwnerID,
 			Link:        cp.makeLinkToPost(&posts[i]),
-		})
-	}
-	return res
-}
-
-func (cp *Crossposter) processBatch(batch []vkReqData) {
-	var res []vkReqResult
-	err := cp.vk.Execute(makeJs(batch, cp.nPostsToFetch), &res)
-	if err != nil {
-		log.Printf("Failed to execute:\n%s\n", err.Error())
-		switch e := err.(type) {
-		case *vkApi.ExecuteErrors:
-			for _, exErr := range *e {
-				log.Printf("Method: %s Code: %d Message: %s\n", exErr.Method, exErr.Code, exErr.Msg)
-			}
-		default:
-			log.Println("Unknown error type: ", reflect.TypeOf(err))
-		}
-	} else {
-		nUpdates := 0
-		time := time.Now().Unix()
-		for i := range res {
-			cp.updateTimeStamp(res[i].Id, res[i].LastPost)
-			nUpdates += len(res[i].Posts)
-			cp.ps.publish(res[i].Id, cp.preparePosts(res[i].Posts, true /*HandleReposts*/))
+			fromID:      posts[i].FromID,
+			pinned:      bool(posts[i].IsPinned),
+			donut:       bool(posts[i].Donut.IsDonut),
 		}
-		if nUpdates > 0 {
-			cp.stats.addUpdate(updateInfo{
-				time,
-				nUpdates,
-			})
-		}
-	}
-}
-
-func (cp *Crossposter) startCrossposting() {
-	batch := make([]vkReqData, 0, cp.batchSize)
-	for {
-		cp.ps.mu.RLock()
-		for id, pub := range cp.ps.pubToSub {
-			batch = append(batch, vkReqData{
-				id,
-				pub.lastPost,
-			})
-			if len(batch)%cp.batchSize == 0 {
-				cp.ps.mu.RUnlock()
-				cp.processBatch(batch)
-				time.Sleep(300 * time.Millisecond)
-				cp.ps.mu.RLock()
-				batch = batch[:0]
+		// Ads are only dropped if they're not intentionally reposted.
+		// For reposts HandleReposts is false, so the ads will be
+		// handled as ordinary posts.
+		post.ad = bool(posts[i].MarkedAsAds) && HandleReposts
+		if posts[i].SignerID != 0 {
+			if signer, err := cp.resolveVkId(int64(posts[i].SignerID)); err == nil {
+				post.author = signer.Name
 			}
 		}
-		cp.ps.mu.RUnlock()
-		if len(batch) > 0 {
-			cp.processBatch(batch)
-			time.Sleep(300 * time.Millisecond)
-			batch = batch[:0]
-		}
-		select {
-		case <-cp.chDone:
-			return
-		case <-time.After(cp.updatePeriod):
-			continue
-		}
+		res = append(res, post)
 	}
+	return res
 }
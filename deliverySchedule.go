@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // quiet hours may be in any time zone
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Destinations may have quiet hours and a delay. Posts which shouldn't be
+// sent yet are stored in delayedPosts table with the time of their release
+// and sent by releaseDelayed, so they survive restarts. Settings of
+// destinations are in deliverySchedules table by subscriber id.
+
+var quietHoursRegex = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])-([01]?[0-9]|2[0-3]):([0-5][0-9])(?:\s+(\S+))?$`)
+
+type deliverySchedule struct {
+	quietFrom int // minutes since midnight, quiet hours are off if equal to quietTo
+	quietTo   int
+	timezone  string // empty for the time zone of the bot
+	loc       *time.Location
+	delay     time.Duration // since publication of the post in the source
+}
+
+func newDeliverySchedule(quietFrom int, quietTo int, timezone string, delayMinutes int) (*deliverySchedule, error) {
+	d := &deliverySchedule{
+		quietFrom: quietFrom,
+		quietTo:   quietTo,
+		timezone:  timezone,
+		loc:       time.Local,
+		delay:     time.Duration(delayMinutes) * time.Minute,
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		d.loc = loc
+	}
+	return d, nil
+}
+
+func (d *deliverySchedule) hasQuietHours() bool {
+	return d.quietFrom != d.quietTo
+}
+
+func (d *deliverySchedule) quiet(t time.Time) bool {
+	if !d.hasQuietHours() {
+		return false
+	}
+	t = t.In(d.loc)
+	m := t.Hour()*60 + t.Minute()
+	if d.quietFrom < d.quietTo {
+		return d.quietFrom <= m && m < d.quietTo
+	}
+	// quiet hours over midnight
+	return m >= d.quietFrom || m < d.quietTo
+}
+
+func (d *deliverySchedule) quietEnd(t time.Time) time.Time {
+	t = t.In(d.loc)
+	y, m, day := t.Date()
+	end := time.Date(y, m, day, d.quietTo/60, d.quietTo%60, 0, 0, d.loc)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// releaseTime is when the post may be sent
+func (d *deliverySchedule) releaseTime(post *preparedPost, now time.Time) time.Time {
+	t := now
+	if d.delay > 0 {
+		published := now
+		if post.date != 0 {
+			published = time.Unix(post.date, 0)
+		}
+		if release := published.Add(d.delay); release.After(t) {
+			t = release
+		}
+	}
+	if d.quiet(t) {
+		t = d.quietEnd(t)
+	}
+	return t
+}
+
+func formatMinutes(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+func (d *deliverySchedule) describe(lang string) string {
+	parts := []string{}
+	if d.hasQuietHours() {
+		tz := d.timezone
+		if tz == "" {
+			tz = i18n[lang].botTimezone
+		}
+		parts = append(parts, fmt.Sprintf(i18n[lang].quietHoursInfo, formatMinutes(d.quietFrom), formatMinutes(d.quietTo), tz))
+	}
+	if d.delay > 0 {
+		parts = append(parts, fmt.Sprintf(i18n[lang].delayInfo, int(d.delay.Minutes())))
+	}
+	if len(parts) == 0 {
+		return i18n[lang].sendImmediately
+	}
+	return strings.Join(parts, ", ")
+}
+
+// holdPosts stores posts which can't be sent yet and returns the rest.
+func (cp *Crossposter) holdPosts(sub int64, schedule *deliverySchedule, u update) update {
+	now := time.Now()
+	ready := update{flags: u.flags}
+	for i := range u.posts {
+		release := schedule.releaseTime(&u.posts[i], now)
+		if !release.After(now) {
+			ready.posts = append(ready.posts, u.posts[i])
+			continue
+		}
+		data, err := marshalPost(&u.posts[i])
+		if err == nil {
+			_, err = cp.db.Exec("insert into delayedPosts (subID, flags, post, releaseAt) values (?, ?, ?, ?);",
+				sub, u.flags, data, release.Unix())
+		}
+		if err != nil {
+			log.Printf("Failed to delay post %s, sending it now:\n%s\n", u.posts[i].Link.rawPostLink, err.Error())
+			ready.posts = append(ready.posts, u.posts[i])
+		}
+	}
+	return ready
+}
+
+// releaseDelayed sends delayed posts which are due
+func (cp *Crossposter) releaseDelayed() {
+	rows, err := cp.db.Query("select id, subID, flags, post from delayedPosts where releaseAt<=? order by releaseAt, id;", time.Now().Unix())
+	if err != nil {
+		log.Printf("Failed to read delayed posts:\n%s\n", err.Error())
+		return
+	}
+	type delayedPost struct {
+		id, subID int64
+		flags     uint64
+		post      string
+	}
+	due := []delayedPost{}
+	for rows.Next() {
+		var d delayedPost
+		if err = rows.Scan(&d.id, &d.subID, &d.flags, &d.post); err != nil {
+			log.Printf("Failed to read delayed post:\n%s\n", err.Error())
+			continue
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	for _, d := range due {
+		post, err := unmarshalPost(d.post)
+		if err != nil {
+			log.Printf("Failed to decode delayed post %d, it is dropped:\n%s\n", d.id, err.Error())
+		} else if !cp.ps.release(d.subID, update{[]preparedPost{post}, d.flags}) {
+			// stopped, the rest will be sent after restart
+			return
+		}
+		if _, err = cp.db.Exec("delete from delayedPosts where id=?;", d.id); err != nil {
+			log.Printf("Failed to delete delayed post %d:\n%s\n", d.id, err.Error())
+		}
+	}
+}
+
+// readDeliverySchedules sets schedules of subscribers read from db
+func (cp *Crossposter) readDeliverySchedules() error {
+	rows, err := cp.db.Query("select subID, quietFrom, quietTo, timezone, delay from deliverySchedules;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var subID int64
+		var quietFrom, quietTo, delay int
+		var timezone string
+		if err = rows.Scan(&subID, &quietFrom, &quietTo, &timezone, &delay); err != nil {
+			return err
+		}
+		schedule, err := newDeliverySchedule(quietFrom, quietTo, timezone, delay)
+		if err != nil {
+			log.Printf("Invalid delivery schedule of subscriber %d, it is ignored:\n%s\n", subID, err.Error())
+			continue
+		}
+		cp.ps.setSchedule(subID, schedule)
+	}
+	return rows.Err()
+}
+
+// findDestination resolves the destination given to /quiet or /delay
+// the same way /add does. Telegram chats are checked for admin rights there,
+// other destinations like webhook urls can be given by anyone who knows them,
+// so the sender must have a subscription to the destination.
+func (cp *Crossposter) findDestination(addr string, c tele.Context) (int64, string, error) {
+	sink, key, name, err := cp.resolveSink(addr, c)
+	if err != nil {
+		return 0, "", err
+	}
+	var subID int64
+	err = cp.dbFindSubStmt.QueryRow(sink.Type(), key).Scan(&subID)
+	if err == nil && sink.Type() != sinkTelegram {
+		var n int
+		err = cp.db.QueryRow("select count(*) from pubSub where subID=? and userID=?;", subID, c.Sender().ID).Scan(&n)
+		if err == nil && n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", userError{code: errNoDestSubs, tgUserOrGroup: addr}
+	}
+	return subID, name, err
+}
+
+func (cp *Crossposter) loadDeliverySchedule(subID int64) (*deliverySchedule, error) {
+	var quietFrom, quietTo, delay int
+	var timezone string
+	err := cp.db.QueryRow("select quietFrom, quietTo, timezone, delay from deliverySchedules where subID=?;", subID).
+		Scan(&quietFrom, &quietTo, &timezone, &delay)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newDeliverySchedule(0, 0, "", 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newDeliverySchedule(quietFrom, quietTo, timezone, delay)
+}
+
+// saveDeliverySchedule stores the schedule and applies it to the subscriber
+func (cp *Crossposter) saveDeliverySchedule(subID int64, d *deliverySchedule) error {
+	var err error
+	if !d.hasQuietHours() && d.delay == 0 {
+		_, err = cp.db.Exec("delete from deliverySchedules where subID=?;", subID)
+		d = nil
+	} else {
+		_, err = cp.db.Exec("insert or replace into deliverySchedules (subID, quietFrom, quietTo, timezone, delay) values (?, ?, ?, ?, ?);",
+			subID, d.quietFrom, d.quietTo, d.timezone, int(d.delay.Minutes()))
+	}
+	if err != nil {
+		return err
+	}
+	cp.ps.setSchedule(subID, d)
+	return nil
+}
+
+func (cp *Crossposter) handleQuiet(c tele.Context) error {
+	matches := cp.quietMsgRegex.FindStringSubmatch(c.Text())
+	if len(matches) != 3 {
+		return userError{code: errInvalidRequest}
+	}
+	lang := getLang(c)
+	subID, name, err := cp.findDestination(matches[1], c)
+	if err != nil {
+		return err
+	}
+	d, err := cp.loadDeliverySchedule(subID)
+	if err != nil {
+		return err
+	}
+	args := strings.TrimSpace(matches[2])
+	switch {
+	case args == "":
+		return c.Send(fmt.Sprintf(i18n[lang].deliverySchedule, name, d.describe(lang)))
+	case args == "off":
+		d.quietFrom, d.quietTo = 0, 0
+	default:
+		m := quietHoursRegex.FindStringSubmatch(args)
+		if m == nil {
+			return userError{code: errInvalidQuietHours}
+		}
+		h1, _ := strconv.Atoi(m[1])
+		m1, _ := strconv.Atoi(m[2])
+		h2, _ := strconv.Atoi(m[3])
+		m2, _ := strconv.Atoi(m[4])
+		d, err = newDeliverySchedule(h1*60+m1, h2*60+m2, m[5], int(d.delay.Minutes()))
+		if err != nil {
+			return userError{code: errInvalidQuietHours}
+		}
+	}
+	if err = cp.saveDeliverySchedule(subID, d); err != nil {
+		return err
+	}
+	return c.Send(fmt.Sprintf(i18n[lang].deliverySchedule, name, d.describe(lang)))
+}
+
+func (cp *Crossposter) handleDelay(c tele.Context) error {
+	matches := cp.delayMsgRegex.FindStringSubmatch(c.Text())
+	if len(matches) != 3 {
+		return userError{code: errInvalidRequest}
+	}
+	lang := getLang(c)
+	subID, name, err := cp.findDestination(matches[1], c)
+	if err != nil {
+		return err
+	}
+	d, err := cp.loadDeliverySchedule(subID)
+	if err != nil {
+		return err
+	}
+	if matches[2] != "" {
+		minutes, _ := strconv.Atoi(matches[2])
+		d.delay = time.Duration(minutes) * time.Minute
+		if err = cp.saveDeliverySchedule(subID, d); err != nil {
+			return err
+		}
+	}
+	return c.Send(fmt.Sprintf(i18n[lang].deliverySchedule, name, d.describe(lang)))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Posts of a subscription in digest mode are not forwarded when they come.
+// Short excerpts of them are stored in digestItems table and sent as one post
+// by schedule: hourly, daily or weekly on mondays at the given time of the
+// bot's time zone. Schedules are in digests table along with the time of
+// the last digest, so nothing is lost on restart.
+
+// length of post excerpts in runes
+const digestExcerptLen = 200
+
+// one album fits ten photos
+const maxDigestPhotos = 10
+
+var digestScheduleRegex = regexp.MustCompile(`^(hourly|daily|weekly)(?:\s+([01]?[0-9]|2[0-3]):([0-5][0-9]))?(\s+photos)?$`)
+
+type digestSchedule struct {
+	period string
+	hour   int
+	minute int
+	photos bool // add first photos of posts as an album
+}
+
+func parseDigestSchedule(s string) (*digestSchedule, error) {
+	m := digestScheduleRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("invalid digest schedule %s", s)
+	}
+	d := &digestSchedule{period: m[1], hour: 9, photos: m[4] != ""}
+	if m[2] != "" {
+		if d.period == "hourly" {
+			return nil, fmt.Errorf("hourly digest has no time")
+		}
+		d.hour, _ = strconv.Atoi(m[2])
+		d.minute, _ = strconv.Atoi(m[3])
+	}
+	return d, nil
+}
+
+func (d *digestSchedule) String() string {
+	s := d.period
+	if d.period != "hourly" {
+		s += fmt.Sprintf(" %02d:%02d", d.hour, d.minute)
+	}
+	if d.photos {
+		s += " photos"
+	}
+	return s
+}
+
+// next returns the time of the first digest after t
+func (d *digestSchedule) next(t time.Time) time.Time {
+	y, m, day := t.Date()
+	switch d.period {
+	case "hourly":
+		return time.Date(y, m, day, t.Hour()+1, 0, 0, 0, t.Location())
+	case "weekly":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		next := time.Date(y, m, day-daysSinceMonday, d.hour, d.minute, 0, 0, t.Location())
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	default:
+		next := time.Date(y, m, day, d.hour, d.minute, 0, 0, t.Location())
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	}
+}
+
+// digestExcerpt is the beginning of the text without links and line breaks
+func digestExcerpt(text string) string {
+	text = renderInlineLinks(text, func(s string) string { return s }, func(url string, text string) string { return text })
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= digestExcerptLen {
+		return string(runes)
+	}
+	cut := digestExcerptLen
+	for i := cut; i > digestExcerptLen/2; i-- {
+		if runes[i] == ' ' {
+			cut = i
+			break
+		}
+	}
+	return string(runes[:cut]) + "…"
+}
+
+// firstPhoto returns the first photo of the post or the posts it reposts
+func firstPhoto(post *preparedPost) (mediaItem, bool) {
+	for _, m := range post.att.media[mediaPhotoVideo] {
+		if !m.isVideo {
+			return m, true
+		}
+	}
+	for i := len(post.copyHistory) - 1; i >= 0; i-- {
+		if m, ok := firstPhoto(&post.copyHistory[i]); ok {
+			return m, true
+		}
+	}
+	return mediaItem{}, false
+}
+
+// collectDigest stores posts for the digest of the subscription.
+func (cp *Crossposter) collectDigest(pubID int64, subID int64, posts []preparedPost) {
+	for i := range posts {
+		post := &posts[i]
+		if post.edited {
+			continue
+		}
+		text := post.text
+		for j := len(post.copyHistory) - 1; j >= 0 && strings.TrimSpace(text) == ""; j-- {
+			text = post.copyHistory[j].text
+		}
+		photo, _ := firstPhoto(post)
+		_, err := cp.db.Exec(`insert into digestItems (pubSubID, text, link, name, photo, tgFileID, time)
+select pubSubID, ?, ?, ?, ?, ?, ? from pubSub where pubID=? and subID=?;`,
+			digestExcerpt(text), post.Link.rawPostLink, post.Link.name, photo.url, photo.tgFileID, time.Now().Unix(), pubID, subID)
+		if err != nil {
+			log.Printf("Failed to save post %s for digest:\n%s\n", post.Link.rawPostLink, err.Error())
+		}
+	}
+}
+
+// flushDigest sends the collected posts of the subscription as one post
+func (cp *Crossposter) flushDigest(pubSubID int64, pubID int64, subID int64, schedule *digestSchedule) error {
+	rows, err := cp.db.Query("select id, text, link, name, photo, tgFileID from digestItems where pubSubID=? order by id;", pubSubID)
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	items := []string{}
+	digest := preparedPost{
+		att:  preparedAttachments{preparedMedia{}, []string{}},
+		date: time.Now().Unix(),
+	}
+	for rows.Next() {
+		var text, link, name, photo, tgFileID string
+		if err = rows.Scan(&lastID, &text, &link, &name, &photo, &tgFileID); err != nil {
+			rows.Close()
+			return err
+		}
+		item := "• " + text
+		if link != "" {
+			if name == "" {
+				name = link
+			}
+			item += " — [" + link + "|" + strings.NewReplacer("[", "(", "]", ")", "|", "/").Replace(name) + "]"
+		}
+		items = append(items, item)
+		if schedule.photos && (photo != "" || tgFileID != "") && len(digest.att.media[mediaPhotoVideo]) < maxDigestPhotos {
+			digest.att.media[mediaPhotoVideo] = append(digest.att.media[mediaPhotoVideo], mediaItem{url: photo, tgFileID: tgFileID})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(items) != 0 {
+		digest.text = fmt.Sprintf(i18n["ru"].digestHeader, len(items)) + "\n\n" + strings.Join(items, "\n\n")
+		if !cp.ps.sendTo(pubID, subID, []preparedPost{digest}) {
+			return nil
+		}
+	}
+	_, err = cp.db.Exec(`
+begin transaction;
+delete from digestItems where pubSubID=? and id<=?;
+update digests set lastSent=? where pubSubID=?;
+commit;`, pubSubID, lastID, time.Now().Unix(), pubSubID)
+	return err
+}
+
+// sendDigests sends digests which are due
+func (cp *Crossposter) sendDigests() {
+	rows, err := cp.db.Query(`select digests.pubSubID, pubSub.pubID, pubSub.subID, digests.schedule, digests.lastSent from digests
+join pubSub on digests.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		log.Printf("Failed to read digests:\n%s\n", err.Error())
+		return
+	}
+	type dueDigest struct {
+		pubSubID, pubID, subID int64
+		schedule               *digestSchedule
+	}
+	due := []dueDigest{}
+	now := time.Now()
+	for rows.Next() {
+		var d dueDigest
+		var schedule string
+		var lastSent int64
+		if err = rows.Scan(&d.pubSubID, &d.pubID, &d.subID, &schedule, &lastSent); err != nil {
+			log.Printf("Failed to read digest:\n%s\n", err.Error())
+			continue
+		}
+		d.schedule, err = parseDigestSchedule(schedule)
+		if err != nil {
+			log.Printf("Invalid digest of pubSub %d:\n%s\n", d.pubSubID, err.Error())
+			continue
+		}
+		if !d.schedule.next(time.Unix(lastSent, 0)).After(now) {
+			due = append(due, d)
+		}
+	}
+	rows.Close()
+	for _, d := range due {
+		if err = cp.flushDigest(d.pubSubID, d.pubID, d.subID, d.schedule); err != nil {
+			log.Printf("Failed to send digest of pubSub %d:\n%s\n", d.pubSubID, err.Error())
+		}
+	}
+}
+
+// readDigests marks subscriptions in digest mode
+func (cp *Crossposter) readDigests() error {
+	rows, err := cp.db.Query(`select pubSub.pubID, pubSub.subID from digests
+join pubSub on digests.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubID, subID int64
+		if err = rows.Scan(&pubID, &subID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.digest = true })
+	}
+	return rows.Err()
+}
+
+func (cp *Crossposter) handleDigest(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.digestMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	args := strings.TrimSpace(rest)
+	switch args {
+	case "":
+		var schedule string
+		err = cp.db.QueryRow("select schedule from digests where pubSubID=?;", pubSubID).Scan(&schedule)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Send(fmt.Sprintf(i18n[lang].digestOff, pubSubID))
+		}
+		if err != nil {
+			return err
+		}
+		return c.Send(fmt.Sprintf(i18n[lang].digestSet, pubSubID, schedule))
+	case "off":
+		var schedule string
+		err = cp.db.QueryRow("select schedule from digests where pubSubID=?;", pubSubID).Scan(&schedule)
+		if err == nil {
+			cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.digest = false })
+			// send what was collected, so that it's not lost
+			d, err := parseDigestSchedule(schedule)
+			if err == nil {
+				err = cp.flushDigest(pubSubID, pubID, subID, d)
+			}
+			if err != nil {
+				log.Printf("Failed to send digest of pubSub %d:\n%s\n", pubSubID, err.Error())
+			}
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		_, err = cp.db.Exec(`
+begin transaction;
+delete from digests where pubSubID=?;
+delete from digestItems where pubSubID=?;
+commit;`, pubSubID, pubSubID)
+		if err != nil {
+			return err
+		}
+		return c.Send(fmt.Sprintf(i18n[lang].digestOff, pubSubID))
+	}
+	d, err := parseDigestSchedule(args)
+	if err != nil {
+		return userError{code: errInvalidDigest}
+	}
+	_, err = cp.db.Exec(`insert into digests (pubSubID, schedule, lastSent) values (?, ?, ?)
+on conflict (pubSubID) do update set schedule=excluded.schedule;`, pubSubID, d.String(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.digest = true })
+	return c.Send(fmt.Sprintf(i18n[lang].digestSet, pubSubID, d.String()))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkDiscord = "discord"
+
+const (
+	discordMaxMsgSize = 2000
+	discordMaxEmbeds  = 10
+)
+
+var (
+	discordRegex        = regexp.MustCompile(`^discord:(https://(?:ptb\.|canary\.)?discord(?:app)?\.com/api/webhooks/([0-9]+)/[a-zA-Z0-9_\-]+)$`)
+	discordMarkdownChar = regexp.MustCompile("([\\\\*_~`|])")
+)
+
+type discordWebhook struct {
+	Name      string `json:"name"`
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+type discordEmbed struct {
+	Image struct {
+		Url string `json:"url"`
+	} `json:"image"`
+}
+
+type discordMessage struct {
+	Content string         `json:"content"`
+	Embeds  []discordEmbed `json:"embeds,omitempty"`
+}
+
+type discordSentMessage struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// discordSink posts to discord channels through webhooks, key is the webhook url.
+// Webhooks can't reply to messages, so instead of replies in repost chains
+// we put a link to the message being reposted. Message refs are such links.
+type discordSink struct {
+	client   *http.Client
+	webhooks CacheMap[string, discordWebhook]
+}
+
+func newDiscordSink() *discordSink {
+	return &discordSink{
+		client:   &http.Client{Timeout: 60 * time.Second},
+		webhooks: NewCacheMap[string, discordWebhook](1000),
+	}
+}
+
+func (s *discordSink) Type() string {
+	return sinkDiscord
+}
+
+func (s *discordSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := discordRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", "", false, nil
+	}
+	wh, err := s.webhook(m[1])
+	if err != nil {
+		log.Printf("Failed to get discord webhook %s:\n%s\n", m[2], err.Error())
+		return "", "", true, userError{code: errNoSuchChannel, tgUserOrGroup: "discord webhook " + m[2]}
+	}
+	return m[1], "discord " + wh.Name, true, nil
+}
+
+func (s *discordSink) Describe(key string) string {
+	m := discordRegex.FindStringSubmatch("discord:" + key)
+	if m == nil {
+		return "[DELETED]"
+	}
+	return "discord webhook " + m[2]
+}
+
+func (s *discordSink) webhook(url string) (discordWebhook, error) {
+	if wh, ok := s.webhooks.Get(url); ok {
+		return wh, nil
+	}
+	var wh discordWebhook
+	r, err := s.client.Get(url)
+	if err != nil {
+		return wh, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return wh, fmt.Errorf("got status %s", r.Status)
+	}
+	if err = json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		return wh, err
+	}
+	s.webhooks.Put(url, wh, approxNDaysFromNow(2))
+	return wh, nil
+}
+
+func renderDiscordMarkdown(text string) string {
+	return renderInlineLinks(text,
+		func(s string) string {
+			return discordMarkdownChar.ReplaceAllString(s, "\\$1")
+		},
+		func(url string, text string) string {
+			text = strings.NewReplacer("[", "", "]", "").Replace(text)
+			return "[" + text + "](" + url + ")"
+		})
+}
+
+// splitDiscordText splits text into messages which fit discord limit.
+// Unlike telegram, discord counts characters of markdown, including link urls,
+// so we look for a split point which fits after rendering.
+func splitDiscordText(text string) []string {
+	res := []string{}
+	text = strings.Trim(text, " \t\n")
+	for len(text) > 0 {
+		target := discordMaxMsgSize
+		var splitIndex, visible int
+		var rendered string
+		for {
+			splitIndex, visible = findIndexToSplit(text, target)
+			rendered = renderDiscordMarkdown(text[:splitIndex])
+			renderedLen := utf8.RuneCountInString(rendered)
+			if renderedLen <= discordMaxMsgSize || target == 1 {
+				break
+			}
+			// shrink proportionally to how much markdown has grown the text,
+			// but at least by one character
+			target = min(visible*discordMaxMsgSize/renderedLen-10, target-1)
+			if target < 1 {
+				target = 1
+			}
+		}
+		// a link which doesn't fit by itself is cut anywhere
+		for runes := []rune(rendered); len(runes) > discordMaxMsgSize; runes = []rune(rendered) {
+			res = append(res, string(runes[:discordMaxMsgSize]))
+			rendered = string(runes[discordMaxMsgSize:])
+		}
+		res = append(res, rendered)
+		text = strings.TrimLeft(text[splitIndex:], " \t\n")
+	}
+	return res
+}
+
+func (s *discordSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	if strings.TrimSpace(post.text) == "" && post.att.Empty() {
+		return "", nil
+	}
+	text := post.text
+	if len(post.att.links) != 0 {
+		text = text + "\n" + strings.Join(post.att.links, "\n")
+	}
+	if flags&flagAddLinkToPost != 0 && post.Link.rawPostLink != "" {
+		text = strings.Trim(text, " \t\n") + "\n\n[" + post.Link.rawPostLink + "|" + post.Link.name + "]"
+	}
+	if replyTo != "" {
+		text = "↪ " + string(replyTo) + "\n" + text
+	}
+	messages := splitDiscordText(text)
+
+	photos := []discordEmbed{}
+	files := []mediaItem{}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			if mediaType == mediaPhotoVideo && !m.isVideo {
+				var e discordEmbed
+				e.Image.Url = m.url
+				photos = append(photos, e)
+			} else {
+				files = append(files, m)
+			}
+		}
+	}
+
+	var first msgRef
+	send := func(msg discordMessage) {
+		ref, err := s.execute(key, msg)
+		if err != nil {
+			log.Printf("Failed to send discord message for post %s:\n%s\n", post.Link.rawPostLink, err.Error())
+			return
+		}
+		if first == "" {
+			first = ref
+		}
+	}
+	for i, content := range messages {
+		msg := discordMessage{Content: content}
+		// photos go with the last piece of text
+		if i == len(messages)-1 {
+			msg.Embeds = photos[:min(len(photos), discordMaxEmbeds)]
+			photos = photos[len(msg.Embeds):]
+		}
+		send(msg)
+	}
+	for len(photos) > 0 {
+		msg := discordMessage{Embeds: photos[:min(len(photos), discordMaxEmbeds)]}
+		photos = photos[len(msg.Embeds):]
+		send(msg)
+	}
+	for _, f := range files {
+		ref, err := s.upload(key, f)
+		if err != nil {
+			// too big for discord or failed to download, so link is all we can do
+			log.Printf("Failed to upload %s to discord:\n%s\n", f.url, err.Error())
+			ref, err = s.execute(key, discordMessage{Content: f.url})
+		}
+		if err == nil && first == "" {
+			first = ref
+		}
+	}
+	if first == "" && (len(messages) > 0 || !post.att.media.Empty()) {
+		return "", fmt.Errorf("nothing was delivered")
+	}
+	return first, nil
+}
+
+func (s *discordSink) execute(url string, msg discordMessage) (msgRef, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return s.post(url, "application/json", func() io.Reader { return bytes.NewReader(body) })
+}
+
+func (s *discordSink) upload(url string, m mediaItem) (msgRef, error) {
+	data, err := downloadMedia(m.url)
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	name := m.title
+	if name == "" {
+		name = path.Base(strings.SplitN(m.url, "?", 2)[0])
+	}
+	fw, err := w.CreateFormFile("files[0]", name)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(fw, data); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	body := buf.Bytes()
+	return s.post(url, w.FormDataContentType(), func() io.Reader { return bytes.NewReader(body) })
+}
+
+// post executes the webhook and returns link to the created message.
+// When rate limited it waits as long as discord asks and tries again.
+func (s *discordSink) post(url string, contentType string, body func() io.Reader) (msgRef, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		r, err := s.client.Post(url+"?wait=true", contentType, body())
+		if err != nil {
+			return "", err
+		}
+		if r.StatusCode == http.StatusTooManyRequests {
+			var limit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.NewDecoder(r.Body).Decode(&limit)
+			r.Body.Close()
+			time.Sleep(time.Duration(limit.RetryAfter*float64(time.Second)) + time.Second)
+			continue
+		}
+		if r.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(r.Body, 1024))
+			r.Body.Close()
+			return "", fmt.Errorf("got status %s: %s", r.Status, msg)
+		}
+		var sent discordSentMessage
+		err = json.NewDecoder(r.Body).Decode(&sent)
+		r.Body.Close()
+		// webhooks are limited to 30 messages a minute in a channel
+		time.Sleep(2 * time.Second)
+		if err != nil {
+			return "", err
+		}
+		guild := "@me"
+		if wh, err := s.webhook(url); err == nil && wh.GuildID != "" {
+			guild = wh.GuildID
+		}
+		return msgRef(fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guild, sent.ChannelID, sent.ID)), nil
+	}
+	return "", fmt.Errorf("rate limited")
+}
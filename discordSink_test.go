@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitDiscordText(t *testing.T) {
+	longLink := "[https://example.org/" + strings.Repeat("p", 900) + "|l]"
+	tests := []struct {
+		name  string
+		text  string
+		links int    // rendered links, counted by their beginning
+		last  string // end of the last part
+	}{
+		{"plain text", strings.Repeat("word ", 1000), 0, "word"},
+		{"run of links", strings.Repeat(longLink+" ", 10), 10, "pp)"},
+		{"link longer than message", "[https://example.org/" + strings.Repeat("p", 2500) + "|l] after", 1, "after"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitDiscordText(tt.text)
+			links := 0
+			for _, p := range parts {
+				if n := utf8.RuneCountInString(p); n > discordMaxMsgSize {
+					t.Errorf("part of %d characters", n)
+				}
+				links += strings.Count(p, "[l](https://example.org/")
+			}
+			if links != tt.links {
+				t.Errorf("%d links are rendered, want %d", links, tt.links)
+			}
+			if !strings.HasSuffix(parts[len(parts)-1], tt.last) {
+				t.Errorf("last part ends with %q", parts[len(parts)-1][len(parts[len(parts)-1])-10:])
+			}
+		})
+	}
+}
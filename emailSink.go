@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	sinkEmail       = "email"
+	sinkEmailDigest = "email-digest"
+)
+
+const (
+	// images beyond this size are linked instead of attached
+	emailMaxInlineSize = 15 << 20
+	emailSubjectLen    = 80
+	// a digest holds at most this many posts. When an address has collected
+	// them, the digest is sent without waiting for the period, and if it
+	// can't be sent, the oldest posts are dropped to keep the limit.
+	emailDigestMaxPosts = 50
+)
+
+// email:user@host or email-digest:user@host
+var emailRegex = regexp.MustCompile(`^(email|email-digest):([^@\s:]+@[a-zA-Z0-9\-\.]+\.[a-zA-Z]+)$`)
+
+type emailImage struct {
+	cid  string
+	mime string
+	data []byte
+}
+
+// emailSection is a rendered post, a letter consists of one or more of them
+type emailSection struct {
+	subject string
+	html    string
+	text    string
+	images  []emailImage
+}
+
+// emailSink sends posts as html letters through smtp server from config.
+// Key is the recipient address. With digest set posts are collected in
+// emailDigestPosts table and sent in one letter every digest period
+// instead of a letter per post. Anyone can be spammed this way, so only
+// bot admins can add addresses.
+type emailSink struct {
+	cp         *Crossposter
+	digest     bool
+	addr       string
+	auth       smtp.Auth
+	from       string
+	mu         sync.Mutex // digests are sent one at a time, so no post goes twice
+	period     time.Duration
+	nextDigest time.Time // only used by scheduled jobs
+}
+
+func newEmailSink(cp *Crossposter, cfg CrossposterConfig, digest bool) *emailSink {
+	s := &emailSink{
+		cp:     cp,
+		digest: digest,
+		addr:   cfg.SmtpAddr,
+		from:   cfg.SmtpFrom,
+	}
+	if cfg.SmtpUser != "" {
+		host, _, _ := strings.Cut(cfg.SmtpAddr, ":")
+		s.auth = smtp.PlainAuth("", cfg.SmtpUser, cfg.SmtpPassword, host)
+	}
+	if digest {
+		s.period = time.Hour * time.Duration(cfg.EmailDigestPeriod)
+		if s.period <= 0 {
+			s.period = 24 * time.Hour
+		}
+		s.nextDigest = time.Now().Add(s.period)
+	}
+	return s
+}
+
+// runJobs sends digests once a period
+func (s *emailSink) runJobs(now time.Time) {
+	if !s.digest || !s.configured() || now.Before(s.nextDigest) {
+		return
+	}
+	s.nextDigest = now.Add(s.period)
+	s.Flush()
+}
+
+func (s *emailSink) configured() bool {
+	return s.addr != "" && s.from != ""
+}
+
+func (s *emailSink) Type() string {
+	if s.digest {
+		return sinkEmailDigest
+	}
+	return sinkEmail
+}
+
+func (s *emailSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := emailRegex.FindStringSubmatch(addr)
+	if m == nil || m[1] != s.Type() {
+		return "", "", false, nil
+	}
+	if !s.configured() {
+		return "", "", true, userError{code: errNotConfigured}
+	}
+	if !s.cp.isUserBotAdmin(c.Sender().ID) {
+		return "", "", true, userError{code: errBotAdminOnly}
+	}
+	key := strings.ToLower(m[2])
+	return key, s.Describe(key), true, nil
+}
+
+func (s *emailSink) Describe(key string) string {
+	if s.digest {
+		return fmt.Sprintf(i18n["ru"].emailDigestTo, key)
+	}
+	return fmt.Sprintf(i18n["ru"].emailTo, key)
+}
+
+func (s *emailSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	if strings.TrimSpace(post.text) == "" && post.att.Empty() {
+		return "", nil
+	}
+	if !s.digest {
+		return s.send(key, []emailSection{renderEmailSection(post)}, replyTo)
+	}
+	data, err := marshalPost(post)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err = s.cp.db.Exec("insert into emailDigestPosts (address, post) values (?, ?);", key, data); err != nil {
+		return "", err
+	}
+	var n int
+	if err = s.cp.db.QueryRow("select count(*) from emailDigestPosts where address=?;", key).Scan(&n); err != nil {
+		return "", err
+	}
+	if n < emailDigestMaxPosts {
+		return "", nil
+	}
+	if err = s.sendDigest(key); err != nil {
+		log.Printf("Failed to send full digest to %s:\n%s\n", key, err.Error())
+		_, err = s.cp.db.Exec(`delete from emailDigestPosts where address=? and id not in
+(select id from emailDigestPosts where address=? order by id desc limit ?);`, key, key, emailDigestMaxPosts)
+	}
+	return "", err
+}
+
+// Flush sends all collected digests, those which fail are retried next time
+func (s *emailSink) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.cp.db.Query("select distinct address from emailDigestPosts;")
+	if err != nil {
+		log.Printf("Failed to read email digests:\n%s\n", err.Error())
+		return
+	}
+	addresses := []string{}
+	for rows.Next() {
+		var to string
+		if err = rows.Scan(&to); err != nil {
+			log.Printf("Failed to read email digest address:\n%s\n", err.Error())
+			continue
+		}
+		addresses = append(addresses, to)
+	}
+	rows.Close()
+	for _, to := range addresses {
+		if err = s.sendDigest(to); err != nil {
+			log.Printf("Failed to send digest to %s:\n%s\n", to, err.Error())
+		}
+	}
+}
+
+// sendDigest sends collected posts of the address in one letter and
+// deletes them. It's called with s.mu locked.
+func (s *emailSink) sendDigest(to string) error {
+	rows, err := s.cp.db.Query("select id, post from emailDigestPosts where address=? order by id limit ?;", to, emailDigestMaxPosts)
+	if err != nil {
+		return err
+	}
+	sections := []emailSection{}
+	var lastID int64
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&lastID, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		post, err := unmarshalPost(data)
+		if err != nil {
+			log.Printf("Failed to decode digest post %d, it is dropped:\n%s\n", lastID, err.Error())
+			continue
+		}
+		sections = append(sections, renderEmailSection(&post))
+	}
+	rows.Close()
+	if len(sections) > 0 {
+		if _, err = s.send(to, sections, ""); err != nil {
+			return err
+		}
+	}
+	_, err = s.cp.db.Exec("delete from emailDigestPosts where address=? and id<=?;", to, lastID)
+	return err
+}
+
+func (s *emailSink) send(to string, sections []emailSection, replyTo msgRef) (msgRef, error) {
+	subject := sections[0].subject
+	if s.digest {
+		subject = fmt.Sprintf(i18n["ru"].emailDigestTitle, len(sections))
+	}
+	msg, id, err := buildEmail(s.from, to, subject, sections, replyTo)
+	if err != nil {
+		return "", err
+	}
+	if err = smtp.SendMail(s.addr, s.auth, s.from, []string{to}, msg); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func renderEmailText(text string) (string, string) {
+	htmlText := renderInlineLinks(text, html.EscapeString, func(url string, text string) string {
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(text))
+	})
+	plainText := renderInlineLinks(text, func(s string) string { return s }, func(url string, text string) string {
+		return text + " (" + url + ")"
+	})
+	return strings.ReplaceAll(htmlText, "\n", "<br>\n"), plainText
+}
+
+func emailSubject(post *preparedPost) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(post.text), "\n")
+	_, line = renderEmailText(line)
+	if utf8.RuneCountInString(line) > emailSubjectLen {
+		line = string([]rune(line)[:emailSubjectLen]) + "…"
+	}
+	switch {
+	case line == "":
+		return post.Link.name
+	case post.Link.name == "":
+		return line
+	}
+	return post.Link.name + ": " + line
+}
+
+// renderEmailSection downloads photos to attach them inline,
+// other media and the source of the post are linked
+func renderEmailSection(post *preparedPost) emailSection {
+	sec := emailSection{subject: emailSubject(post)}
+	var h, t strings.Builder
+
+	text := strings.Trim(post.text, " \t\n")
+	if len(post.att.links) != 0 {
+		text = strings.TrimLeft(text+"\n"+strings.Join(post.att.links, "\n"), "\n")
+	}
+	htmlText, plainText := renderEmailText(text)
+	h.WriteString("<div>" + htmlText + "</div>\n")
+	t.WriteString(plainText + "\n")
+
+	inlineSize := 0
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			if mediaType == mediaPhotoVideo && !m.isVideo && inlineSize < emailMaxInlineSize {
+				img, err := downloadEmailImage(m.url)
+				if err == nil {
+					inlineSize += len(img.data)
+					sec.images = append(sec.images, img)
+					h.WriteString(fmt.Sprintf("<p><img src=\"cid:%s\" style=\"max-width:100%%\"></p>\n", img.cid))
+					continue
+				}
+				log.Printf("Failed to download %s for email:\n%s\n", m.url, err.Error())
+			}
+			name := m.title
+			if m.performer != "" {
+				name = m.performer + " - " + name
+			}
+			if name == "" {
+				name = m.url
+			}
+			h.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(m.url), html.EscapeString(name)))
+			t.WriteString(m.url + "\n")
+		}
+	}
+
+	if post.Link.rawPostLink != "" {
+		name := post.Link.name
+		if name == "" {
+			name = post.Link.rawPostLink
+		}
+		h.WriteString(fmt.Sprintf("<hr><p><small>%s: <a href=\"%s\">%s</a></small></p>\n",
+			i18n["ru"].emailSource, html.EscapeString(post.Link.rawPostLink), html.EscapeString(name)))
+		t.WriteString("\n-- \n" + i18n["ru"].emailSource + ": " + post.Link.rawPostLink + "\n")
+	}
+	sec.html = h.String()
+	sec.text = t.String()
+	return sec
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func downloadEmailImage(url string) (emailImage, error) {
+	body, err := downloadMedia(url)
+	if err != nil {
+		return emailImage{}, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, emailMaxInlineSize))
+	if err != nil {
+		return emailImage{}, err
+	}
+	mimeType := mimeFromUrl(url)
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = "image/jpeg"
+	}
+	return emailImage{cid: randomHex(8) + "@crossposter", mime: mimeType, data: data}, nil
+}
+
+// buildEmail makes multipart/related letter with text and html alternatives
+// and inline images. It returns the letter and its Message-ID.
+func buildEmail(from string, to string, subject string, sections []emailSection, replyTo msgRef) ([]byte, msgRef, error) {
+	_, domain, _ := strings.Cut(from, "@")
+	id := msgRef(fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomHex(4), domain))
+
+	var buf bytes.Buffer
+	related := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", id)
+	if replyTo != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\nReferences: %s\r\n", replyTo, replyTo)
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/related; type=\"multipart/alternative\"; boundary=%s\r\n\r\n", related.Boundary())
+
+	var altBody bytes.Buffer
+	alt := multipart.NewWriter(&altBody)
+	var h, t strings.Builder
+	h.WriteString("<!DOCTYPE html>\n<html><body>\n")
+	for i, sec := range sections {
+		if i > 0 {
+			h.WriteString("<br><hr><br>\n")
+			t.WriteString("\n\n")
+		}
+		h.WriteString(sec.html)
+		t.WriteString(sec.text)
+	}
+	h.WriteString("</body></html>\n")
+	for _, part := range []struct{ mime, body string }{
+		{"text/plain", t.String()},
+		{"text/html", h.String()},
+	} {
+		w, err := alt.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.mime + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.body)); err != nil {
+			return nil, "", err
+		}
+		qp.Close()
+	}
+	if err := alt.Close(); err != nil {
+		return nil, "", err
+	}
+	w, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alt.Boundary()},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = altBody.WriteTo(w); err != nil {
+		return nil, "", err
+	}
+
+	for _, sec := range sections {
+		for _, img := range sec.images {
+			w, err := related.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {img.mime},
+				"Content-Transfer-Encoding": {"base64"},
+				"Content-ID":                {"<" + img.cid + ">"},
+				"Content-Disposition":       {"inline"},
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			encoded := base64.StdEncoding.EncodeToString(img.data)
+			for len(encoded) > 76 {
+				io.WriteString(w, encoded[:76]+"\r\n")
+				encoded = encoded[76:]
+			}
+			io.WriteString(w, encoded+"\r\n")
+		}
+	}
+	if err = related.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), id, nil
+}
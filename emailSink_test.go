@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStub accepts letters like an smtp server without extensions
+type smtpStub struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	letters []string
+}
+
+func newSmtpStub(t *testing.T) *smtpStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data, err := io.ReadAll(r.DotReader())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.letters = append(s.letters, string(data))
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func (s *smtpStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.letters...)
+}
+
+type parsedEmail struct {
+	subject string
+	text    string
+	html    string
+	images  map[string]string // content id to data
+}
+
+func parseTestEmail(t *testing.T, letter string) parsedEmail {
+	msg, err := mail.ReadMessage(strings.NewReader(letter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := parsedEmail{images: map[string]string{}}
+	if res.subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("letter is %s, want multipart/related", mediaType)
+	}
+	related := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := related.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "multipart/alternative" {
+			if part.Header.Get("Content-Transfer-Encoding") != "base64" {
+				t.Errorf("%s isn't base64", mediaType)
+			}
+			data, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+			res.images[part.Header.Get("Content-ID")] = mediaType + " " + string(data)
+			continue
+		}
+		alt := multipart.NewReader(part, params["boundary"])
+		for {
+			p, err := alt.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the reader decodes quoted-printable itself
+			data, _ := io.ReadAll(p)
+			if strings.HasPrefix(p.Header.Get("Content-Type"), "text/html") {
+				res.html = string(data)
+			} else {
+				res.text = string(data)
+			}
+		}
+	}
+	return res
+}
+
+func newTestEmailSink(t *testing.T, digest bool) (*emailSink, *smtpStub) {
+	smtpServer := newSmtpStub(t)
+	cp := newTestCrossposter(t)
+	s := newEmailSink(cp, CrossposterConfig{SmtpAddr: smtpServer.ln.Addr().String(), SmtpFrom: "bot@example.org"}, digest)
+	return s, smtpServer
+}
+
+func TestEmailLetter(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("png data"))
+	}))
+	defer files.Close()
+	s, smtpServer := newTestEmailSink(t, false)
+
+	post := &preparedPost{
+		text: "Title line\nsee [https://example.org/a|this]",
+		Link: postLink{rawPostLink: "https://vk.com/wall-1_2", name: "Group"},
+	}
+	post.att.media[mediaPhotoVideo] = []mediaItem{{url: files.URL + "/photo.png"}}
+	post.att.media[mediaDoc] = []mediaItem{{url: "https://example.org/doc.pdf", title: "doc.pdf"}}
+	ref, err := s.Deliver("user@example.com", post, 0, "<previous@example.org>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := smtpServer.received()
+	if len(letters) != 1 {
+		t.Fatalf("got %d letters", len(letters))
+	}
+	if !strings.Contains(letters[0], "Message-ID: "+string(ref)) || !strings.Contains(letters[0], "In-Reply-To: <previous@example.org>") {
+		t.Errorf("letter has no Message-ID %s or In-Reply-To header:\n%s", ref, letters[0])
+	}
+	letter := parseTestEmail(t, letters[0])
+	if letter.subject != "Group: Title line" {
+		t.Errorf("subject is %q", letter.subject)
+	}
+	for _, want := range []string{
+		`Title line<br>`,
+		`see <a href="https://example.org/a">this</a>`,
+		`<a href="https://example.org/doc.pdf">doc.pdf</a>`,
+		`Источник: <a href="https://vk.com/wall-1_2">Group</a>`,
+	} {
+		if !strings.Contains(letter.html, want) {
+			t.Errorf("html has no %s:\n%s", want, letter.html)
+		}
+	}
+	for _, want := range []string{"see this (https://example.org/a)", "https://example.org/doc.pdf", "-- \nИсточник: https://vk.com/wall-1_2"} {
+		if !strings.Contains(letter.text, want) {
+			t.Errorf("text has no %s:\n%s", want, letter.text)
+		}
+	}
+	if len(letter.images) != 1 {
+		t.Fatalf("got %d inline images", len(letter.images))
+	}
+	for cid, img := range letter.images {
+		if !strings.Contains(letter.html, `src="cid:`+strings.Trim(cid, "<>")+`"`) {
+			t.Errorf("image %s isn't referenced in html", cid)
+		}
+		if img != "image/png png data" {
+			t.Errorf("image is %s", img)
+		}
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	s, smtpServer := newTestEmailSink(t, true)
+	for _, text := range []string{"first post", "second post"} {
+		post := &preparedPost{text: text, Link: postLink{rawPostLink: "https://vk.com/wall-1_2", name: "Group"}}
+		if _, err := s.Deliver("user@example.com", post, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Deliver("other@example.com", &preparedPost{text: "other post"}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(smtpServer.received()); n != 0 {
+		t.Fatalf("%d letters are sent before the digest period", n)
+	}
+
+	// collected posts survive restart
+	s = newEmailSink(s.cp, CrossposterConfig{SmtpAddr: s.addr, SmtpFrom: s.from}, true)
+	s.Flush()
+	letters := smtpServer.received()
+	if len(letters) != 2 {
+		t.Fatalf("got %d letters, want one per address", len(letters))
+	}
+	var digest parsedEmail
+	for _, l := range letters {
+		if strings.Contains(l, "To: user@example.com") {
+			digest = parseTestEmail(t, l)
+		}
+	}
+	if want := fmt.Sprintf(i18n["ru"].emailDigestTitle, 2); digest.subject != want {
+		t.Errorf("subject is %q", digest.subject)
+	}
+	first, second := strings.Index(digest.html, "first post"), strings.Index(digest.html, "second post")
+	if first < 0 || second < first || !strings.Contains(digest.html[first:second], "<hr>") {
+		t.Errorf("posts aren't separated in order:\n%s", digest.html)
+	}
+
+	s.Flush()
+	if n := len(smtpServer.received()); n != 2 {
+		t.Errorf("sent digests are sent again, got %d letters", n)
+	}
+}
+
+func TestEmailDigestLimit(t *testing.T) {
+	s, smtpServer := newTestEmailSink(t, true)
+	for i := 0; i < emailDigestMaxPosts+1; i++ {
+		if _, err := s.Deliver("user@example.com", &preparedPost{text: fmt.Sprintf("post %d", i)}, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	letters := smtpServer.received()
+	if len(letters) != 1 {
+		t.Fatalf("got %d letters, want the full digest sent right away", len(letters))
+	}
+	if subject := parseTestEmail(t, letters[0]).subject; subject != fmt.Sprintf(i18n["ru"].emailDigestTitle, emailDigestMaxPosts) {
+		t.Errorf("subject is %q", subject)
+	}
+	var n int
+	if err := s.cp.db.QueryRow("select count(*) from emailDigestPosts;").Scan(&n); err != nil || n != 1 {
+		t.Errorf("%d posts are left after full digest, err %v", n, err)
+	}
+
+	// nothing listens there, the oldest posts are dropped
+	s.addr = "127.0.0.1:1"
+	for i := 0; i < emailDigestMaxPosts; i++ {
+		if _, err := s.Deliver("user@example.com", &preparedPost{text: fmt.Sprintf("more %d", i)}, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.cp.db.QueryRow("select count(*) from emailDigestPosts;").Scan(&n); err != nil || n != emailDigestMaxPosts {
+		t.Errorf("%d posts are kept when digest can't be sent, want %d, err %v", n, emailDigestMaxPosts, err)
+	}
+}
+
+func TestEmailDigestPeriod(t *testing.T) {
+	s, smtpServer := newTestEmailSink(t, true)
+	if _, err := s.Deliver("user@example.com", &preparedPost{text: "post"}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.runJobs(now)
+	if n := len(smtpServer.received()); n != 0 {
+		t.Fatalf("%d letters are sent before the digest period", n)
+	}
+	s.runJobs(now.Add(s.period))
+	if n := len(smtpServer.received()); n != 1 {
+		t.Fatalf("got %d letters after the digest period", n)
+	}
+	if !s.nextDigest.After(now.Add(s.period)) {
+		t.Errorf("next digest is at %s", s.nextDigest)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	tele "gopkg.in/telebot.v3"
+)
+
+// A subscription to a vk wall may forward only posts which gain enough
+// likes, reposts or views within a window after publication. Such posts are
+// kept in engagementCandidates table and their counters are checked with
+// wall.getById after every poll. A post is forwarded as soon as it reaches
+// any of the thresholds and dropped when the window ends. Thresholds are
+// in thresholds table by pubSubID, zero means the counter is not checked.
+
+// wall.getById takes at most 100 posts
+const maxPostsByID = 100
+
+// posts older than this can't be waited for
+const maxThresholdWindow = 7 * 24
+
+type engagementThreshold struct {
+	likes   int
+	reposts int
+	views   int
+	window  int // hours since publication
+}
+
+func parseThreshold(s string) (engagementThreshold, error) {
+	t := engagementThreshold{window: 24}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return t, fmt.Errorf("invalid threshold %s", s)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil || n < 0 {
+			return t, fmt.Errorf("invalid number %s", fields[i+1])
+		}
+		switch fields[i] {
+		case "likes":
+			t.likes = n
+		case "reposts":
+			t.reposts = n
+		case "views":
+			t.views = n
+		case "within":
+			t.window = n
+		default:
+			return t, fmt.Errorf("unknown counter %s", fields[i])
+		}
+	}
+	if t.likes == 0 && t.reposts == 0 && t.views == 0 {
+		return t, fmt.Errorf("no thresholds in %s", s)
+	}
+	if t.window < 1 || t.window > maxThresholdWindow {
+		return t, fmt.Errorf("window of %d hours is out of range", t.window)
+	}
+	return t, nil
+}
+
+func (t *engagementThreshold) reached(likes int, reposts int, views int) bool {
+	return (t.likes > 0 && likes >= t.likes) ||
+		(t.reposts > 0 && reposts >= t.reposts) ||
+		(t.views > 0 && views >= t.views)
+}
+
+func (t *engagementThreshold) describe(lang string) string {
+	parts := []string{}
+	if t.likes > 0 {
+		parts = append(parts, fmt.Sprintf(i18n[lang].thresholdLikes, t.likes))
+	}
+	if t.reposts > 0 {
+		parts = append(parts, fmt.Sprintf(i18n[lang].thresholdReposts, t.reposts))
+	}
+	if t.views > 0 {
+		parts = append(parts, fmt.Sprintf(i18n[lang].thresholdViews, t.views))
+	}
+	return strings.Join(parts, i18n[lang].thresholdOr)
+}
+
+// watchPosts stores posts as candidates of the subscription.
+func (cp *Crossposter) watchPosts(pubID int64, subID int64, posts []preparedPost) {
+	for i := range posts {
+		post := &posts[i]
+		if post.ownerID == 0 || post.ID == 0 {
+			log.Printf("Post %s has no vk id, its counters can't be checked\n", post.Link.rawPostLink)
+			continue
+		}
+		published := post.date
+		if published == 0 {
+			published = time.Now().Unix()
+		}
+		data, err := marshalPost(post)
+		if err == nil {
+			_, err = cp.db.Exec(`insert into engagementCandidates (pubSubID, ownerID, postID, post, expireAt)
+select pubSub.pubSubID, ?, ?, ?, ? + thresholds.hours * 3600
+from pubSub join thresholds on pubSub.pubSubID = thresholds.pubSubID where pubID=? and subID=?;`,
+				post.ownerID, post.ID, data, published, pubID, subID)
+		}
+		if err != nil {
+			log.Printf("Failed to save candidate post %s:\n%s\n", post.Link.rawPostLink, err.Error())
+		}
+	}
+}
+
+type engagementCandidate struct {
+	id        int64
+	pubSubID  int64
+	pubID     int64
+	subID     int64
+	vkPostID  string // owner_post as wall.getById takes it
+	post      string
+	expireAt  int64
+	threshold engagementThreshold
+}
+
+type engagementCounters struct {
+	likes, reposts, views int
+}
+
+// fetchCounters returns counters of the posts by owner_post, deleted
+// and hidden posts are missing
+func (cp *Crossposter) fetchCounters(ids []string) (map[string]engagementCounters, error) {
+	res := make(map[string]engagementCounters, len(ids))
+	for start := 0; start < len(ids); start += maxPostsByID {
+		end := min(start+maxPostsByID, len(ids))
+		posts, err := cp.vk.WallGetByID(vkApi.Params{"posts": strings.Join(ids[start:end], ",")})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range posts {
+			res[fmt.Sprintf("%d_%d", p.OwnerID, p.ID)] = engagementCounters{p.Likes.Count, p.Reposts.Count, p.Views.Count}
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	return res, nil
+}
+
+// checkEngagement forwards candidates which reached thresholds
+// and drops those which didn't in time
+func (cp *Crossposter) checkEngagement() {
+	rows, err := cp.db.Query(`select c.id, c.pubSubID, pubSub.pubID, pubSub.subID, c.ownerID, c.postID, c.post, c.expireAt,
+t.likes, t.reposts, t.views, t.hours from engagementCandidates c
+join pubSub on c.pubSubID = pubSub.pubSubID
+join thresholds t on c.pubSubID = t.pubSubID order by c.id;`)
+	if err != nil {
+		log.Printf("Failed to read candidate posts:\n%s\n", err.Error())
+		return
+	}
+	candidates := []engagementCandidate{}
+	ids := []string{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var c engagementCandidate
+		var ownerID, postID int64
+		err = rows.Scan(&c.id, &c.pubSubID, &c.pubID, &c.subID, &ownerID, &postID, &c.post, &c.expireAt,
+			&c.threshold.likes, &c.threshold.reposts, &c.threshold.views, &c.threshold.window)
+		if err != nil {
+			log.Printf("Failed to read candidate post:\n%s\n", err.Error())
+			continue
+		}
+		c.vkPostID = fmt.Sprintf("%d_%d", ownerID, postID)
+		candidates = append(candidates, c)
+		if !seen[c.vkPostID] {
+			seen[c.vkPostID] = true
+			ids = append(ids, c.vkPostID)
+		}
+	}
+	rows.Close()
+	if len(candidates) == 0 {
+		return
+	}
+	counters, err := cp.fetchCounters(ids)
+	if err != nil {
+		log.Printf("Failed to get counters of %d posts:\n%s\n", len(ids), err.Error())
+		return
+	}
+	now := time.Now().Unix()
+	for _, c := range candidates {
+		n, exists := counters[c.vkPostID]
+		reached := exists && c.threshold.reached(n.likes, n.reposts, n.views)
+		if !reached && exists && c.expireAt > now {
+			continue
+		}
+		if reached {
+			post, err := unmarshalPost(c.post)
+			if err != nil {
+				log.Printf("Failed to decode candidate post %d, it is dropped:\n%s\n", c.id, err.Error())
+			} else if !cp.ps.engaged(c.pubID, c.subID, []preparedPost{post}) {
+				// stopped, the rest will be checked after restart
+				return
+			}
+		}
+		if _, err = cp.db.Exec("delete from engagementCandidates where id=?;", c.id); err != nil {
+			log.Printf("Failed to delete candidate post %d:\n%s\n", c.id, err.Error())
+		}
+	}
+}
+
+// readThresholds marks subscriptions with thresholds
+func (cp *Crossposter) readThresholds() error {
+	rows, err := cp.db.Query(`select pubSub.pubID, pubSub.subID from thresholds
+join pubSub on thresholds.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubID, subID int64
+		if err = rows.Scan(&pubID, &subID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.threshold = true })
+	}
+	return rows.Err()
+}
+
+func (cp *Crossposter) handleThreshold(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.thresholdRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	args := strings.TrimSpace(rest)
+	switch args {
+	case "":
+		var t engagementThreshold
+		err = cp.db.QueryRow("select likes, reposts, views, hours from thresholds where pubSubID=?;", pubSubID).
+			Scan(&t.likes, &t.reposts, &t.views, &t.window)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Send(fmt.Sprintf(i18n[lang].thresholdOff, pubSubID))
+		}
+		if err != nil {
+			return err
+		}
+		return c.Send(fmt.Sprintf(i18n[lang].thresholdSet, pubSubID, t.window, t.describe(lang)))
+	case "off":
+		// candidates didn't make it, they are dropped
+		_, err = cp.db.Exec(`
+begin transaction;
+delete from thresholds where pubSubID=?;
+delete from engagementCandidates where pubSubID=?;
+commit;`, pubSubID, pubSubID)
+		if err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.threshold = false })
+		return c.Send(fmt.Sprintf(i18n[lang].thresholdOff, pubSubID))
+	}
+	var srcType string
+	if err = cp.db.QueryRow("select type from publishers where id=?;", pubID).Scan(&srcType); err != nil {
+		return err
+	}
+	if srcType != sourceVkWall && srcType != sourceVkSearch {
+		return userError{code: errThresholdVkOnly}
+	}
+	t, err := parseThreshold(args)
+	if err != nil {
+		return userError{code: errInvalidThreshold}
+	}
+	_, err = cp.db.Exec("insert or replace into thresholds (pubSubID, likes, reposts, views, hours) values (?, ?, ?, ?, ?);",
+		pubSubID, t.likes, t.reposts, t.views, t.window)
+	if err != nil {
+		return err
+	}
+	cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.threshold = true })
+	return c.Send(fmt.Sprintf(i18n[lang].thresholdSet, pubSubID, t.window, t.describe(lang)))
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceFeed = "feed"
+
+var (
+	feedUrlRegex   = regexp.MustCompile(`^https?://\S+$`)
+	htmlBreakRegex = regexp.MustCompile(`(?i)<br\s*/?>|</div>|</li>`)
+	htmlParaRegex  = regexp.MustCompile(`(?i)</p>|</h[1-6]>|</blockquote>`)
+	htmlLinkRegex  = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	htmlTagRegex   = regexp.MustCompile(`(?s)<[^>]*>`)
+	manyNewlines   = regexp.MustCompile(`\n{3,}`)
+)
+
+// RSS 2.0 with enclosures and Media RSS extension
+type rssEnclosure struct {
+	Url  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+type rssMediaContent struct {
+	Url    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+}
+type rssItem struct {
+	Title       string            `xml:"title"`
+	Link        string            `xml:"link"`
+	Description string            `xml:"description"`
+	Guid        string            `xml:"guid"`
+	PubDate     string            `xml:"pubDate"`
+	Enclosures  []rssEnclosure    `xml:"enclosure"`
+	Media       []rssMediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+}
+type rssFeed struct {
+	Title string    `xml:"channel>title"`
+	Items []rssItem `xml:"channel>item"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary"`
+	Content   string     `xml:"content"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+}
+type atomFeed struct {
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedEntry is an item of either rss or atom feed
+type feedEntry struct {
+	guid        string
+	title       string
+	link        string
+	description string // html
+	date        int64  // 0 if unknown
+	enclosures  []rssEnclosure
+}
+
+type feed struct {
+	title   string
+	entries []feedEntry
+}
+
+// feedSource polls RSS and Atom feeds, key is the feed url.
+// Entries are deduplicated by guid, seen guids are kept in feedEntries table.
+type feedSource struct {
+	cp     *Crossposter
+	client *http.Client
+}
+
+func newFeedSource(cp *Crossposter) *feedSource {
+	return &feedSource{
+		cp:     cp,
+		client: newPublicHttpClient(30 * time.Second),
+	}
+}
+
+// newPublicHttpClient makes a client for urls given by users. It doesn't
+// connect to loopback, private and link-local addresses, so that the bot
+// can't be used to reach its own host or network. The address is checked
+// when connecting, which covers redirects and names resolving to such addresses.
+func newPublicHttpClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("connecting to %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect on our behalf without the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+func (s *feedSource) Type() string {
+	return sourceFeed
+}
+
+func (s *feedSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	if !feedUrlRegex.MatchString(addr) {
+		return "", false, nil
+	}
+	if _, err := s.fetch(addr); err != nil {
+		log.Printf("Failed to fetch feed %s:\n%s\n", addr, err.Error())
+		return "", true, userError{code: errNoSuchFeed, vkUserOrGroup: addr}
+	}
+	return addr, true, nil
+}
+
+func (s *feedSource) Describe(key string) string {
+	return key
+}
+
+func (s *feedSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+func (s *feedSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		f, err := s.fetch(pub.key)
+		if err != nil {
+			log.Printf("Failed to fetch feed %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		posts, cursor, err := s.newPosts(pub, f)
+		if err != nil {
+			log.Printf("Failed to check seen entries of feed %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		if len(posts) > 0 || cursor != pub.cursor {
+			emit(sourceUpdate{
+				pubID:  pub.id,
+				cursor: cursor,
+				posts:  posts,
+			})
+		}
+	}
+}
+
+// newPosts returns entries with guids we haven't seen yet and marks them seen.
+// When the feed is polled for the first time, we only send entries published
+// after it was added, because feeds usually contain lots of old entries.
+func (s *feedSource) newPosts(pub publisherRef, f *feed) ([]preparedPost, int64, error) {
+	seen := make(map[string]bool)
+	rows, err := s.cp.db.Query("select guid from feedEntries where pubID=?;", pub.id)
+	if err != nil {
+		return nil, pub.cursor, err
+	}
+	for rows.Next() {
+		var guid string
+		if err = rows.Scan(&guid); err != nil {
+			rows.Close()
+			return nil, pub.cursor, err
+		}
+		seen[guid] = true
+	}
+	rows.Close()
+	firstPoll := len(seen) == 0
+
+	now := time.Now().Unix()
+	cursor := pub.cursor
+	fresh := []feedEntry{}
+	for _, e := range f.entries {
+		_, err = s.cp.db.Exec("insert or replace into feedEntries (pubID, guid, lastSeen) values (?, ?, ?);",
+			pub.id, e.guid, now)
+		if err != nil {
+			return nil, pub.cursor, err
+		}
+		if seen[e.guid] || (firstPoll && e.date <= pub.cursor) {
+			continue
+		}
+		seen[e.guid] = true
+		fresh = append(fresh, e)
+		if e.date > cursor {
+			cursor = e.date
+		}
+	}
+	// forget entries which are long gone from the feed
+	_, err = s.cp.db.Exec("delete from feedEntries where pubID=? and lastSeen<?;", pub.id, now-30*24*3600)
+	if err != nil {
+		log.Printf("Failed to clean up entries of feed %s:\n%s\n", pub.key, err.Error())
+	}
+
+	fresh = sortFeedEntries(fresh)
+	if len(fresh) > s.cp.nPostsToFetch {
+		fresh = fresh[len(fresh)-s.cp.nPostsToFetch:]
+	}
+
+	res := make([]preparedPost, 0, len(fresh))
+	for i := range fresh {
+		res = append(res, prepareFeedEntry(&fresh[i], f.title))
+	}
+	return res, cursor, nil
+}
+
+// sortFeedEntries orders entries from oldest to newest. Feeds list newest
+// entries first, so they are reversed, and undated entries are sorted as
+// the entry before them in that order to keep their place next to it.
+func sortFeedEntries(entries []feedEntry) []feedEntry {
+	n := len(entries)
+	order := make([]int, n)
+	dates := make([]int64, n)
+	var prev int64
+	for i := range entries {
+		e := &entries[n-1-i]
+		if e.date != 0 {
+			prev = e.date
+		}
+		order[i], dates[n-1-i] = n-1-i, prev
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return dates[order[i]] < dates[order[j]]
+	})
+	res := make([]feedEntry, 0, n)
+	for _, i := range order {
+		res = append(res, entries[i])
+	}
+	return res
+}
+
+func (s *feedSource) fetch(url string) (*feed, error) {
+	r, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", r.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseFeed(data)
+}
+
+func parseFeed(data []byte) (*feed, error) {
+	var probe struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	switch probe.XMLName.Local {
+	case "rss":
+		var rss rssFeed
+		if err := xml.Unmarshal(data, &rss); err != nil {
+			return nil, err
+		}
+		res := &feed{title: strings.TrimSpace(rss.Title)}
+		for _, item := range rss.Items {
+			e := feedEntry{
+				guid:        strings.TrimSpace(item.Guid),
+				title:       strings.TrimSpace(item.Title),
+				link:        strings.TrimSpace(item.Link),
+				description: item.Description,
+				date:        parseFeedDate(item.PubDate),
+				enclosures:  item.Enclosures,
+			}
+			for _, m := range item.Media {
+				t := m.Type
+				if t == "" && m.Medium != "" {
+					t = m.Medium + "/"
+				}
+				e.enclosures = append(e.enclosures, rssEnclosure{Url: m.Url, Type: t})
+			}
+			res.entries = append(res.entries, e.withGuid())
+		}
+		return res, nil
+	case "feed":
+		var atom atomFeed
+		if err := xml.Unmarshal(data, &atom); err != nil {
+			return nil, err
+		}
+		res := &feed{title: strings.TrimSpace(atom.Title)}
+		for _, entry := range atom.Entries {
+			e := feedEntry{
+				guid:        strings.TrimSpace(entry.ID),
+				title:       strings.TrimSpace(entry.Title),
+				description: entry.Content,
+				date:        parseFeedDate(entry.Published),
+			}
+			if e.description == "" {
+				e.description = entry.Summary
+			}
+			if e.date == 0 {
+				e.date = parseFeedDate(entry.Updated)
+			}
+			for _, l := range entry.Links {
+				switch l.Rel {
+				case "", "alternate":
+					if e.link == "" {
+						e.link = l.Href
+					}
+				case "enclosure":
+					e.enclosures = append(e.enclosures, rssEnclosure{Url: l.Href, Type: l.Type})
+				}
+			}
+			res.entries = append(res.entries, e.withGuid())
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown feed format %s", probe.XMLName.Local)
+}
+
+// withGuid makes up a guid for entries which don't have one
+func (e feedEntry) withGuid() feedEntry {
+	if e.guid == "" {
+		e.guid = e.link
+	}
+	if e.guid == "" {
+		e.guid = fmt.Sprintf("%s %d", e.title, e.date)
+	}
+	return e
+}
+
+func parseFeedDate(date string) int64 {
+	date = strings.TrimSpace(date)
+	if date == "" {
+		return 0
+	}
+	layouts := []string{
+		time.RFC1123Z,
+		time.RFC1123,
+		time.RFC3339,
+		"Mon, 2 Jan 2006 15:04:05 -0700",
+		"Mon, 2 Jan 2006 15:04:05 MST",
+		"2 Jan 2006 15:04:05 -0700",
+	}
+	for _, l := range layouts {
+		if t, err := time.Parse(l, date); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+// htmlToText converts html from feeds to plain text with inline links
+func htmlToText(s string) string {
+	s = htmlBreakRegex.ReplaceAllString(s, "\n")
+	s = htmlParaRegex.ReplaceAllString(s, "\n\n")
+	s = htmlLinkRegex.ReplaceAllStringFunc(s, func(a string) string {
+		m := htmlLinkRegex.FindStringSubmatch(a)
+		url := html.UnescapeString(m[1])
+		text := strings.TrimSpace(html.UnescapeString(htmlTagRegex.ReplaceAllString(m[2], "")))
+		// hashtags and mentions are better left as they are
+		if text == "" || text == url || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "@") ||
+			strings.ContainsAny(text, "[]|") || !strings.HasPrefix(url, "http") {
+			if text == "" {
+				return url
+			}
+			return text
+		}
+		// escape it back because the whole text is unescaped below
+		return "[" + html.EscapeString(url) + "|" + html.EscapeString(text) + "]"
+	})
+	s = htmlTagRegex.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.ReplaceAll(s, "\r", "")
+	s = manyNewlines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+// mediaFromMime puts a file into the bucket for its mime type
+func mediaFromMime(media *preparedMedia, url string, mime string) {
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		media[mediaPhotoVideo] = append(media[mediaPhotoVideo], mediaItem{url: url})
+	case strings.HasPrefix(mime, "video/"):
+		media[mediaPhotoVideo] = append(media[mediaPhotoVideo], mediaItem{url: url, isVideo: true})
+	case strings.HasPrefix(mime, "audio/"):
+		media[mediaAudio] = append(media[mediaAudio], mediaItem{url: url})
+	default:
+		media[mediaDoc] = append(media[mediaDoc], mediaItem{url: url})
+	}
+}
+
+func prepareFeedEntry(e *feedEntry, feedTitle string) preparedPost {
+	text := htmlToText(e.description)
+	title := htmlToText(e.title)
+	if title != "" && !strings.HasPrefix(text, title) {
+		if text == "" {
+			text = title
+		} else {
+			text = title + "\n\n" + text
+		}
+	}
+	att := preparedAttachments{preparedMedia{}, []string{}}
+	for _, enc := range e.enclosures {
+		if enc.Url != "" {
+			mediaFromMime(&att.media, enc.Url, enc.Type)
+		}
+	}
+	name := feedTitle
+	if name == "" {
+		name = e.link
+	}
+	return preparedPost{
+		att:  att,
+		text: text,
+		date: e.date,
+		Link: postLink{
+			rawPostLink: e.link,
+			name:        name,
+		},
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCrossposter returns a crossposter with an empty database in a temporary directory
+func newTestCrossposter(t *testing.T) *Crossposter {
+	cp := &Crossposter{dbName: filepath.Join(t.TempDir(), "test.db"), subsLimit: 10, nPostsToFetch: 10}
+	if err := cp.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cp.db.Close() })
+	return cp
+}
+
+// feedFixture serves the rss document it holds, tests change it between polls
+type feedFixture struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (f *feedFixture) set(items ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.body = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel><title>Test feed</title>
+` + strings.Join(items, "\n") + `
+</channel></rss>`
+}
+
+func (f *feedFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/rss+xml")
+	w.Write([]byte(f.body))
+}
+
+func feedItem(guid string, title string, date time.Time, extra string) string {
+	return fmt.Sprintf(`<item><guid>%s</guid><title>%s</title><link>https://example.org/%s</link>
+<pubDate>%s</pubDate><description>text of %s</description>%s</item>`,
+		guid, title, guid, date.Format(time.RFC1123Z), title, extra)
+}
+
+func pollFeed(t *testing.T, s *feedSource, pub *publisherRef) []preparedPost {
+	var posts []preparedPost
+	s.Poll([]publisherRef{*pub}, func(u sourceUpdate) {
+		if u.pubID != pub.id {
+			t.Errorf("update of publisher %d, want %d", u.pubID, pub.id)
+		}
+		pub.cursor = u.cursor
+		posts = append(posts, u.posts...)
+	})
+	return posts
+}
+
+func postTitles(posts []preparedPost) []string {
+	res := []string{}
+	for i := range posts {
+		res = append(res, strings.SplitN(posts[i].text, "\n", 2)[0])
+	}
+	return res
+}
+
+func newTestFeed(t *testing.T) (*feedSource, *feedFixture, *publisherRef) {
+	fixture := &feedFixture{}
+	srv := httptest.NewServer(fixture)
+	t.Cleanup(srv.Close)
+	cp := newTestCrossposter(t)
+	res, err := cp.db.Exec("insert into publishers (type, key, lastPost) values (?, ?, 0);", sourceFeed, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	s := newFeedSource(cp)
+	// the fixture is on loopback which feeds can't use
+	s.client = srv.Client()
+	return s, fixture, &publisherRef{id: id, key: srv.URL}
+}
+
+func TestFeedRejectsLocalAddresses(t *testing.T) {
+	srv := httptest.NewServer(&feedFixture{})
+	defer srv.Close()
+	s := newFeedSource(newTestCrossposter(t))
+	if _, err := s.fetch(srv.URL); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("feed on loopback is fetched, err %v", err)
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "172.16.0.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "0.0.0.0", "::ffff:127.0.0.1"} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s is considered public", ip)
+		}
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s is not considered public", ip)
+		}
+	}
+}
+
+func TestFeedFirstPollSkipsOldEntries(t *testing.T) {
+	s, fixture, pub := newTestFeed(t)
+	added := time.Now().Add(-time.Hour).Truncate(time.Second)
+	pub.cursor = added.Unix()
+	fixture.set(
+		feedItem("3", "newest", added.Add(30*time.Minute), ""),
+		feedItem("2", "new", added.Add(10*time.Minute), ""),
+		feedItem("1", "old", added.Add(-24*time.Hour), ""),
+	)
+
+	posts := pollFeed(t, s, pub)
+	if got := strings.Join(postTitles(posts), ","); got != "new,newest" {
+		t.Errorf("first poll sent %s, want entries after the feed was added, oldest first", got)
+	}
+	if want := added.Add(30 * time.Minute).Unix(); pub.cursor != want {
+		t.Errorf("cursor is %d, want %d", pub.cursor, want)
+	}
+	if posts[0].Link.rawPostLink != "https://example.org/2" || posts[0].Link.name != "Test feed" {
+		t.Errorf("unexpected link %+v", posts[0].Link)
+	}
+
+	// old entry was seen on the first poll and isn't sent later
+	if posts = pollFeed(t, s, pub); len(posts) != 0 {
+		t.Errorf("second poll of the same feed sent %v", postTitles(posts))
+	}
+}
+
+func TestFeedDedupByGuid(t *testing.T) {
+	s, fixture, pub := newTestFeed(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	pub.cursor = start.Unix()
+	fixture.set(feedItem("a", "first", start.Add(time.Minute), ""))
+	if got := postTitles(pollFeed(t, s, pub)); len(got) != 1 || got[0] != "first" {
+		t.Fatalf("first poll sent %v", got)
+	}
+
+	// edited entry keeps its guid, entries without guid are told apart by link
+	// and keep their place in the feed, on top it's the newest one
+	fixture.set(
+		`<item><title>no guid</title><link>https://example.org/noguid</link><description>x</description></item>`,
+		feedItem("b", "second", start.Add(2*time.Minute), ""),
+		feedItem("a", "first edited", start.Add(3*time.Minute), ""),
+	)
+	if got := strings.Join(postTitles(pollFeed(t, s, pub)), ","); got != "second,no guid" {
+		t.Errorf("second poll sent %s, want only entries with new guids", got)
+	}
+	if got := postTitles(pollFeed(t, s, pub)); len(got) != 0 {
+		t.Errorf("third poll sent %v", got)
+	}
+}
+
+func TestFeedEnclosures(t *testing.T) {
+	s, fixture, pub := newTestFeed(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	pub.cursor = start.Unix()
+	fixture.set(feedItem("m", "media", start.Add(time.Minute), `
+<enclosure url="https://example.org/photo.jpg" type="image/jpeg" length="1"/>
+<enclosure url="https://example.org/song.mp3" type="audio/mpeg" length="1"/>
+<enclosure url="https://example.org/paper.pdf" type="application/pdf" length="1"/>
+<media:content url="https://example.org/clip.mp4" medium="video"/>
+<enclosure url="" type="image/png"/>`))
+
+	posts := pollFeed(t, s, pub)
+	if len(posts) != 1 {
+		t.Fatalf("got %d posts", len(posts))
+	}
+	media := posts[0].att.media
+	want := map[int][]mediaItem{
+		mediaPhotoVideo: {{url: "https://example.org/photo.jpg"}, {url: "https://example.org/clip.mp4", isVideo: true}},
+		mediaAudio:      {{url: "https://example.org/song.mp3"}},
+		mediaDoc:        {{url: "https://example.org/paper.pdf"}},
+	}
+	for mediaType, items := range want {
+		if len(media[mediaType]) != len(items) {
+			t.Errorf("media type %d has %v, want %v", mediaType, media[mediaType], items)
+			continue
+		}
+		for i := range items {
+			if media[mediaType][i] != items[i] {
+				t.Errorf("media type %d item %d is %+v, want %+v", mediaType, i, media[mediaType][i], items[i])
+			}
+		}
+	}
+	if posts[0].text != "media\n\ntext of media" {
+		t.Errorf("text is %q", posts[0].text)
+	}
+}
+
+func TestSortFeedEntries(t *testing.T) {
+	// newest first like in feeds, undated entries stay after their older neighbour
+	entries := []feedEntry{
+		{title: "a", date: 10}, {title: "u1"}, {title: "b", date: 3},
+		{title: "c", date: 7}, {title: "u2"},
+	}
+	var got []string
+	for _, e := range sortFeedEntries(entries) {
+		got = append(got, e.title)
+	}
+	if strings.Join(got, ",") != "u2,b,u1,c,a" {
+		t.Errorf("entries are sorted as %v", got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Filter rules of a subscription are stored in filters table one per row
+// in the form they were typed in /filter: + or - followed by a keyword,
+// #hashtag, /regex/ or one of the :media and :text conditions.
+// A post passes the filter if it matches any of the + rules (or there
+// are none) and none of the - rules. Text of reposted posts counts too.
+
+const (
+	ruleKeyword = iota
+	ruleHashtag
+	ruleRegex
+	ruleHasMedia
+	ruleTextOnly
+)
+
+var hashtagRegex = regexp.MustCompile(`#[\p{L}\p{N}_]+`)
+
+type filterRule struct {
+	raw     string
+	exclude bool
+	kind    int
+	word    string // lowercase keyword or hashtag
+	re      *regexp.Regexp
+}
+
+// postFilter is nil for subscriptions without rules
+type postFilter struct {
+	rules []filterRule
+}
+
+func parseFilterRule(raw string) (filterRule, error) {
+	rule := filterRule{raw: raw}
+	if len(raw) < 2 || (raw[0] != '+' && raw[0] != '-') {
+		return rule, fmt.Errorf("rule must start with + or -")
+	}
+	rule.exclude = raw[0] == '-'
+	body := raw[1:]
+	switch {
+	case body == ":media":
+		rule.kind = ruleHasMedia
+	case body == ":text":
+		rule.kind = ruleTextOnly
+	case len(body) > 2 && strings.HasPrefix(body, "/") && strings.HasSuffix(body, "/"):
+		re, err := regexp.Compile("(?i)" + body[1:len(body)-1])
+		if err != nil {
+			return rule, err
+		}
+		rule.kind = ruleRegex
+		rule.re = re
+	case hashtagRegex.FindString(body) == body:
+		rule.kind = ruleHashtag
+		rule.word = strings.ToLower(body)
+	default:
+		rule.kind = ruleKeyword
+		rule.word = strings.ToLower(body)
+	}
+	return rule, nil
+}
+
+func newPostFilter(rawRules []string) (*postFilter, error) {
+	if len(rawRules) == 0 {
+		return nil, nil
+	}
+	f := &postFilter{}
+	for _, raw := range rawRules {
+		rule, err := parseFilterRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+// filterText is the text of the post and its repost chain
+func filterText(post *preparedPost) string {
+	texts := []string{post.text}
+	for i := range post.copyHistory {
+		texts = append(texts, post.copyHistory[i].text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func hasMedia(post *preparedPost) bool {
+	if !post.att.Empty() {
+		return true
+	}
+	for i := range post.copyHistory {
+		if hasMedia(&post.copyHistory[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *filterRule) match(text string, lowerText string, media bool) bool {
+	switch r.kind {
+	case ruleHasMedia:
+		return media
+	case ruleTextOnly:
+		return !media && strings.TrimSpace(text) != ""
+	case ruleRegex:
+		return r.re.MatchString(text)
+	case ruleHashtag:
+		for _, tag := range hashtagRegex.FindAllString(lowerText, -1) {
+			if tag == r.word {
+				return true
+			}
+		}
+		return false
+	default:
+		return strings.Contains(lowerText, r.word)
+	}
+}
+
+func (f *postFilter) match(post *preparedPost) bool {
+	text := filterText(post)
+	lowerText := strings.ToLower(text)
+	media := hasMedia(post)
+	included, hasIncludes := false, false
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.exclude {
+			if r.match(text, lowerText, media) {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		if !included && r.match(text, lowerText, media) {
+			included = true
+		}
+	}
+	return included || !hasIncludes
+}
+
+// apply returns posts which pass the filter
+func (f *postFilter) apply(posts []preparedPost) []preparedPost {
+	if f == nil {
+		return posts
+	}
+	res := make([]preparedPost, 0, len(posts))
+	for i := range posts {
+		if f.match(&posts[i]) {
+			res = append(res, posts[i])
+		}
+	}
+	return res
+}
+
+// readFilters sets filters of subscriptions read from db
+func (cp *Crossposter) readFilters() error {
+	return cp.readSubscriptionRules("filters", func(pubSubID int64, pubID int64, subID int64, rules []string) {
+		filter, err := newPostFilter(rules)
+		if err != nil {
+			log.Printf("Invalid filter of pubSub %d, it is ignored:\n%s\n", pubSubID, err.Error())
+			return
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.filter = filter })
+	})
+}
+
+func (cp *Crossposter) handleFilter(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.filterMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	args := strings.Fields(rest)
+	if len(args) == 1 && args[0] == "clear" {
+		if _, err = cp.db.Exec("delete from filters where pubSubID=?;", pubSubID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.filter = nil })
+		return c.Send(fmt.Sprintf(i18n[lang].filtersCleared, pubSubID))
+	}
+	for _, raw := range args {
+		if _, err = parseFilterRule(raw); err != nil {
+			return userError{code: errInvalidFilter, vkUserOrGroup: raw}
+		}
+	}
+	if len(args) > 0 {
+		tx, err := cp.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, raw := range args {
+			if _, err = tx.Exec("insert or ignore into filters (pubSubID, rule) values (?, ?);", pubSubID, raw); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	rules, err := cp.loadSubscriptionRules("filters", pubSubID)
+	if err != nil {
+		return err
+	}
+	filter, err := newPostFilter(rules)
+	if err != nil {
+		return err
+	}
+	cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.filter = filter })
+	if len(rules) == 0 {
+		return c.Send(fmt.Sprintf(i18n[lang].noFilters, pubSubID))
+	}
+	return c.Send(fmt.Sprintf(i18n[lang].filterList, pubSubID, html.EscapeString(strings.Join(rules, "\n"))))
+}
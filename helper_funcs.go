@@ -20,11 +20,11 @@ var res = [];
 var i = 0;
 while (i < batch.length) {
 	var filtered = [];
-	var posts = API.wall.get({"owner_id": batch[i].id, "count": postCount}).items;
+	var posts = API.wall.get({"owner_id": batch[i].owner, "count": postCount}).items;
 	var j = 0;
 	var lastPost = 0;
 	while (j < posts.length) {
-		if (posts[j].date > batch[i].lastPost && !posts[j].marked_as_ads) {
+		if (posts[j].date > batch[i].lastPost && (batch[i].ads || !posts[j].marked_as_ads)) {
 			filtered.push(posts[j]);
 			if (posts[j].date > lastPost) {
 				lastPost = posts[j].date;
@@ -114,16 +114,43 @@ func lowerBound[T any](slice []T, val *T, comp func(*T, *T) bool) int {
 	return left
 }
 
+// Inline links in vk format look like [linkOrId|text]. Besides vk links we
+// also use this format for links to any other site found in non-vk sources.
 var inlineLinkRegex *regexp.Regexp = regexp.MustCompile(`\[` +
 	`(?:` +
 	`(?:(?:https?://)?vk\.(?:com|me|ru)/)([a-zA-Z0-9_\-\.\?=/@]+)` +
 	`|` +
 	`((?:club|id)[0-9]+)` +
+	`|` +
+	`(https?://[^\s|\[\]]+)` +
 	`)` +
 	`\|` +
 	`([^]\[]+)` +
 	`\]`)
 
+// renderInlineLinks converts text with inline links into sink format.
+// Parts of text outside of links are passed to plain, and links to link.
+func renderInlineLinks(text string, plain func(string) string, link func(url string, text string) string) string {
+	var sb strings.Builder
+	prev := 0
+	for _, m := range inlineLinkRegex.FindAllStringSubmatchIndex(text, -1) {
+		sb.WriteString(plain(text[prev:m[0]]))
+		var url string
+		switch {
+		case m[2] >= 0:
+			url = "https://vk.com/" + text[m[2]:m[3]]
+		case m[4] >= 0:
+			url = "https://vk.com/" + text[m[4]:m[5]]
+		default:
+			url = text[m[6]:m[7]]
+		}
+		sb.WriteString(link(url, text[m[8]:m[9]]))
+		prev = m[1]
+	}
+	sb.WriteString(plain(text[prev:]))
+	return sb.String()
+}
+
 func findIndexToSplit(text string, target int) (int, int) {
 
 	/*
@@ -156,8 +183,8 @@ func findIndexToSplit(text string, target int) (int, int) {
 		if curMatch < len(matches) {
 			if matches[curMatch][0] <= i && i < matches[curMatch][1] {
 				// if we're inside link, don't count any characters which will not be rendered.
-				// indices 6 and 7 contain bounds of the rendered link text
-				if matches[curMatch][6] <= i && i < matches[curMatch][7] {
+				// indices 8 and 9 contain bounds of the rendered link text
+				if matches[curMatch][8] <= i && i < matches[curMatch][9] {
 					charCount++
 				}
 				continue
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFindIndexToSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		target int
+		index  int
+		length int
+	}{
+		{"fits", "hello world", 100, 11, 11},
+		{"empty", "", 10, 0, 0},
+		{"last space before target", "hello world", 8, 5, 5},
+		{"space right at target", "hello world", 5, 5, 5},
+		{"newline", "line one\nline two", 12, 8, 8},
+		{"no separators", "abcdefghij", 4, 4, 4},
+		{"multibyte runes", "привет мир", 8, len("привет"), 6},
+		{"multibyte without separators", "абвгдежз", 3, len("абв"), 3},
+		{"link markup isn't counted", "[id1|Pavel] hi", 8, 14, 8},
+		{"link text isn't split", "see [https://example.org/long/path|the link] after", 10, 3, 3},
+		{"split after link", "[club1|Group name] and some more", 20, 27, 19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, length := findIndexToSplit(tt.text, tt.target)
+			if index != tt.index || length != tt.length {
+				t.Errorf("findIndexToSplit(%q, %d) = %d, %d, want %d, %d", tt.text, tt.target, index, length, tt.index, tt.length)
+			}
+		})
+	}
+}
+
+func TestRenderInlineLinks(t *testing.T) {
+	plain := func(s string) string { return strings.ToUpper(s) }
+	link := func(url string, text string) string { return "<" + url + " " + text + ">" }
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"no links", "NO LINKS"},
+		{"[id1|Pavel]", "<https://vk.com/id1 Pavel>"},
+		{"[club1|Group]", "<https://vk.com/club1 Group>"},
+		{"[vk.com/durov|Durov]", "<https://vk.com/durov Durov>"},
+		{"[https://vk.me/durov|Durov]", "<https://vk.com/durov Durov>"},
+		{"[https://example.org/a?b=c|site]", "<https://example.org/a?b=c site>"},
+		{"a [id1|b] c [https://x.org|d] e", "A <https://vk.com/id1 b> C <https://x.org d> E"},
+		{"[not a link] [https://x.org|]", "[NOT A LINK] [HTTPS://X.ORG|]"},
+	}
+	for _, tt := range tests {
+		if got := renderInlineLinks(tt.text, plain, link); got != tt.want {
+			t.Errorf("renderInlineLinks(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// splitting the whole text like sinks do gives pieces within the limit
+// with every link in one piece
+func TestFindIndexToSplitPieces(t *testing.T) {
+	text := strings.Repeat("word [https://example.org/some/long/path|link with spaces] и слово ", 30)
+	const target = 100
+	rendered := renderTgHTML(text)
+	pieces := []string{}
+	for len(text) > 0 {
+		index, length := findIndexToSplit(text, target)
+		if index == 0 {
+			t.Fatalf("no progress at %q", text)
+		}
+		piece := text[:index]
+		if length > target {
+			t.Errorf("piece %q is %d characters long", piece, length)
+		}
+		if n := strings.Count(piece, "["); n != strings.Count(piece, "]") {
+			t.Errorf("link is split in piece %q", piece)
+		}
+		if !utf8.ValidString(piece) {
+			t.Errorf("rune is split in piece %q", piece)
+		}
+		pieces = append(pieces, renderTgHTML(piece))
+		text = strings.TrimLeft(text[index:], " \t\n")
+	}
+	if got := strings.TrimSpace(strings.Join(pieces, " ")); got != strings.TrimSpace(rendered) {
+		t.Errorf("pieces don't add up to the text:\n%s\nwant\n%s", got, rendered)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The http server is optional and is shared by everything that needs to
+// receive or serve something over http. It's disabled if HttpAddr is empty.
+
+func (cp *Crossposter) initHttpServer(cfg CrossposterConfig) {
+	if cfg.HttpAddr == "" {
+		return
+	}
+	cp.httpMux = http.NewServeMux()
+	cp.httpServer = &http.Server{
+		Addr:         cfg.HttpAddr,
+		Handler:      cp.httpMux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	cp.httpBaseUrl = strings.TrimRight(cfg.HttpBaseUrl, "/")
+	if cp.httpBaseUrl == "" {
+		cp.httpBaseUrl = "http://" + cfg.HttpAddr
+	}
+}
+
+func (cp *Crossposter) startHttpServer() {
+	if cp.httpServer == nil {
+		return
+	}
+	log.Printf("Listening for http requests on %s\n", cp.httpServer.Addr)
+	err := cp.httpServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Http server failed:\n%s\n", err.Error())
+	}
+}
+
+func (cp *Crossposter) stopHttpServer() {
+	if cp.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cp.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down http server:\n%s\n", err.Error())
+	}
+}
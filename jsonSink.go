@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkJson = "json"
+
+const (
+	jsonMaxAttempts  = 5
+	jsonFirstBackoff = 2 * time.Second
+	// how long delivery log is kept
+	jsonLogDays = 30
+)
+
+var jsonSinkRegex = regexp.MustCompile(`^json:(https?://\S+)$`)
+
+type jsonMedia struct {
+	Type      string `json:"type"`
+	Url       string `json:"url"`
+	Title     string `json:"title,omitempty"`
+	Performer string `json:"performer,omitempty"`
+}
+
+// jsonPost is the document posted to json webhooks
+type jsonPost struct {
+	// vk ids of the post, zero for other sources
+	OwnerID     int         `json:"owner_id"`
+	ID          int         `json:"id"`
+	Text        string      `json:"text"`
+	Media       []jsonMedia `json:"media"`
+	Links       []string    `json:"links"`
+	Link        string      `json:"link"`
+	Name        string      `json:"name"`
+	CopyHistory []jsonPost  `json:"copy_history,omitempty"`
+}
+
+// jsonSink posts every post with its whole repost chain as one json
+// document to the url which is its key. Requests are signed with
+// a secret generated for the url, each attempt to deliver is logged
+// to jsonDeliveries table. As the bot can be made to post anywhere,
+// only bot admins can add such subscribers.
+type jsonSink struct {
+	cp     *Crossposter
+	client *http.Client
+}
+
+func newJsonSink(cp *Crossposter) *jsonSink {
+	return &jsonSink{
+		cp:     cp,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *jsonSink) Type() string {
+	return sinkJson
+}
+
+func (s *jsonSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := jsonSinkRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", "", false, nil
+	}
+	if !s.cp.isUserBotAdmin(c.Sender().ID) {
+		return "", "", true, userError{code: errBotAdminOnly}
+	}
+	url := m[1]
+	_, err := s.secret(url)
+	if errors.Is(err, sql.ErrNoRows) {
+		secret := randomHex(32)
+		_, err = s.cp.db.Exec("insert into jsonHookSecrets (url, secret) values (?, ?);", url, secret)
+		if err != nil {
+			return "", "", true, err
+		}
+		// the name gets to logs and replies, so the secret is sent
+		// to the admin once in private and nowhere else
+		lang := getLang(c)
+		_, err = s.cp.tgBot.Send(c.Sender(), fmt.Sprintf(i18n[lang].jsonHookSecret, html.EscapeString(url), secret))
+		if err != nil {
+			// nobody knows the secret, a new one is made next time
+			s.cp.db.Exec("delete from jsonHookSecrets where url=?;", url)
+		}
+	}
+	if err != nil {
+		return "", "", true, err
+	}
+	return url, url, true, nil
+}
+
+func (s *jsonSink) Describe(key string) string {
+	return "json " + key
+}
+
+func (s *jsonSink) deliversCopyHistory() {}
+
+func (s *jsonSink) secret(url string) (string, error) {
+	var secret string
+	err := s.cp.db.QueryRow("select secret from jsonHookSecrets where url=?;", url).Scan(&secret)
+	return secret, err
+}
+
+func makeJsonPost(post *preparedPost) jsonPost {
+	res := jsonPost{
+		OwnerID: post.ownerID,
+		ID:      post.ID,
+		Text:    post.text,
+		Media:   []jsonMedia{},
+		Links:   post.att.links,
+		Link:    post.Link.rawPostLink,
+		Name:    post.Link.name,
+	}
+	if res.Links == nil {
+		res.Links = []string{}
+	}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			t := "doc"
+			switch {
+			case mediaType == mediaAudio:
+				t = "audio"
+			case mediaType == mediaPhotoVideo && m.isVideo:
+				t = "video"
+			case mediaType == mediaPhotoVideo:
+				t = "photo"
+			}
+			res.Media = append(res.Media, jsonMedia{Type: t, Url: m.url, Title: m.title, Performer: m.performer})
+		}
+	}
+	for i := range post.copyHistory {
+		res.CopyHistory = append(res.CopyHistory, makeJsonPost(&post.copyHistory[i]))
+	}
+	return res
+}
+
+func signJson(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *jsonSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	secret, err := s.secret(key)
+	if err != nil {
+		return "", fmt.Errorf("no secret for json webhook:\n%w", err)
+	}
+	body, err := json.Marshal(makeJsonPost(post))
+	if err != nil {
+		return "", err
+	}
+
+	var status, attempt int
+	backoff := jsonFirstBackoff
+	for attempt = 1; attempt <= jsonMaxAttempts; attempt++ {
+		var retry bool
+		status, retry, err = s.post(key, secret, body)
+		if err == nil || !retry || attempt == jsonMaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	now := time.Now().Unix()
+	res, logErr := s.cp.db.Exec(`insert into jsonDeliveries (url, postLink, status, attempts, error, time)
+values (?, ?, ?, ?, ?, ?);`, key, post.Link.rawPostLink, status, attempt, errText, now)
+	if logErr != nil {
+		log.Printf("Failed to log json delivery to %s:\n%s\n", key, logErr.Error())
+	}
+	s.cp.db.Exec("delete from jsonDeliveries where time<?;", now-jsonLogDays*24*3600)
+	if err != nil {
+		return "", err
+	}
+	if logErr != nil {
+		return "", nil
+	}
+	id, _ := res.LastInsertId()
+	return msgRef(strconv.FormatInt(id, 10)), nil
+}
+
+// post sends the document once and tells if it's worth trying again
+func (s *jsonSink) post(url string, secret string, body []byte) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Crossposter-Signature", signJson(secret, body))
+	r, err := s.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer r.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(r.Body, 4096))
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return r.StatusCode, false, nil
+	}
+	retry := r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests
+	return r.StatusCode, retry, fmt.Errorf("got status %s", r.Status)
+}
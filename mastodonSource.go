@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceMastodon = "mastodon"
+
+// https://instance/@user or @user@instance
+var mastodonRegex = regexp.MustCompile(`^(?:(?:https?://([a-zA-Z0-9\-\.]+)/@([a-zA-Z0-9_]+)/?)|(?:@([a-zA-Z0-9_]+)@([a-zA-Z0-9\-\.]+)))$`)
+
+type mastodonAccount struct {
+	ID          string `json:"id"`
+	Acct        string `json:"acct"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Url         string `json:"url"`
+}
+
+type mastodonAttachment struct {
+	Type        string `json:"type"`
+	Url         string `json:"url"`
+	Description string `json:"description"`
+}
+
+type mastodonStatus struct {
+	ID               string               `json:"id"`
+	CreatedAt        time.Time            `json:"created_at"`
+	Url              string               `json:"url"`
+	Uri              string               `json:"uri"`
+	Content          string               `json:"content"`
+	SpoilerText      string               `json:"spoiler_text"`
+	Account          mastodonAccount      `json:"account"`
+	Reblog           *mastodonStatus      `json:"reblog"`
+	MediaAttachments []mastodonAttachment `json:"media_attachments"`
+}
+
+// mastodonSource polls public statuses of mastodon accounts through
+// the client api of their instance, which doesn't need a token.
+// Key is user@instance, cursor is the creation time of the latest status.
+type mastodonSource struct {
+	cp        *Crossposter
+	client    *http.Client
+	accountID CacheMap[string, string]
+}
+
+func newMastodonSource(cp *Crossposter) *mastodonSource {
+	return &mastodonSource{
+		cp:        cp,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		accountID: NewCacheMap[string, string](1000),
+	}
+}
+
+func (s *mastodonSource) Type() string {
+	return sourceMastodon
+}
+
+func (s *mastodonSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := mastodonRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	user, instance := m[2], m[1]
+	if user == "" {
+		user, instance = m[3], m[4]
+	}
+	key := user + "@" + strings.ToLower(instance)
+	if _, err := s.lookup(key); err != nil {
+		log.Printf("Failed to look up mastodon account %s:\n%s\n", key, err.Error())
+		return "", true, userError{code: errNoSuchAccount, vkUserOrGroup: "@" + key}
+	}
+	return key, true, nil
+}
+
+func (s *mastodonSource) Describe(key string) string {
+	return "@" + key
+}
+
+func (s *mastodonSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+func (s *mastodonSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		statuses, err := s.statuses(pub.key)
+		if err != nil {
+			log.Printf("Failed to get statuses of %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		cursor := pub.cursor
+		posts := []preparedPost{}
+		// statuses come newest first
+		for i := len(statuses) - 1; i >= 0; i-- {
+			created := statuses[i].CreatedAt.Unix()
+			if created <= pub.cursor {
+				continue
+			}
+			if created > cursor {
+				cursor = created
+			}
+			posts = append(posts, prepareMastodonStatus(&statuses[i], true))
+		}
+		if len(posts) > 0 {
+			emit(sourceUpdate{
+				pubID:  pub.id,
+				cursor: cursor,
+				posts:  posts,
+			})
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+func splitMastodonKey(key string) (string, string) {
+	user, instance, _ := strings.Cut(key, "@")
+	return user, instance
+}
+
+func (s *mastodonSource) get(instance string, path string, query url.Values, res interface{}) error {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     instance,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	r, err := s.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s for %s", r.Status, u.String())
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+func (s *mastodonSource) lookup(key string) (string, error) {
+	if id, ok := s.accountID.Get(key); ok {
+		return id, nil
+	}
+	user, instance := splitMastodonKey(key)
+	var acc mastodonAccount
+	err := s.get(instance, "/api/v1/accounts/lookup", url.Values{"acct": {user}}, &acc)
+	if err != nil {
+		return "", err
+	}
+	if acc.ID == "" {
+		return "", fmt.Errorf("no account id in response")
+	}
+	s.accountID.Put(key, acc.ID, approxNDaysFromNow(7))
+	return acc.ID, nil
+}
+
+func (s *mastodonSource) statuses(key string) ([]mastodonStatus, error) {
+	id, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	_, instance := splitMastodonKey(key)
+	var res []mastodonStatus
+	err = s.get(instance, "/api/v1/accounts/"+url.PathEscape(id)+"/statuses", url.Values{
+		"limit":           {strconv.Itoa(min(s.cp.nPostsToFetch, 40))},
+		"exclude_replies": {"true"},
+	}, &res)
+	return res, err
+}
+
+// mastodon ids are strings and not necessarily numbers,
+// while posts are compared by owner ids to detect reposts from other pages
+func mastodonOwnerID(id string) int {
+	if n, err := strconv.Atoi(id); err == nil {
+		return n
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32())
+}
+
+// prepareMastodonStatus converts a status into a post. Boosts are treated
+// like vk reposts: the boosted status goes to copy history.
+func prepareMastodonStatus(st *mastodonStatus, handleReblogs bool) preparedPost {
+	link := st.Url
+	if link == "" {
+		link = st.Uri
+	}
+	name := st.Account.DisplayName
+	if name == "" {
+		name = st.Account.Acct
+	}
+	post := preparedPost{
+		att:     preparedAttachments{preparedMedia{}, []string{}},
+		ownerID: mastodonOwnerID(st.Account.ID),
+		date:    st.CreatedAt.Unix(),
+		Link: postLink{
+			rawPostLink: link,
+			name:        name,
+		},
+	}
+	if st.Reblog != nil && handleReblogs {
+		post.copyHistory = []preparedPost{prepareMastodonStatus(st.Reblog, false)}
+		return post
+	}
+
+	post.text = htmlToText(st.Content)
+	if st.SpoilerText != "" {
+		post.text = "CW: " + st.SpoilerText + "\n\n" + post.text
+	}
+	for _, a := range st.MediaAttachments {
+		switch a.Type {
+		case "image":
+			post.att.media[mediaPhotoVideo] = append(post.att.media[mediaPhotoVideo], mediaItem{url: a.Url})
+		case "video", "gifv":
+			post.att.media[mediaPhotoVideo] = append(post.att.media[mediaPhotoVideo], mediaItem{url: a.Url, isVideo: true})
+		case "audio":
+			post.att.media[mediaAudio] = append(post.att.media[mediaAudio], mediaItem{url: a.Url, title: a.Description})
+		default:
+			post.att.media[mediaDoc] = append(post.att.media[mediaDoc], mediaItem{url: a.Url})
+		}
+	}
+	return post
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkMatrix = "matrix"
+
+// matrix has no limit on message length except 64KiB per event,
+// so we split only really long texts
+const matrixMaxMsgSize = 16000
+
+// upload limit of homeservers which don't tell theirs, it's the synapse default
+const matrixDefaultUploadSize = 50 << 20
+
+// matrix:!roomid:server or matrix:#alias:server
+var matrixRegex = regexp.MustCompile(`^matrix:([!#][^:\s]+:[a-zA-Z0-9\-\.:]+)$`)
+
+type matrixError struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+// matrixSink sends posts to matrix rooms through client-server api,
+// as a user whose access token is set in config. Key is the room id,
+// message refs are event ids.
+type matrixSink struct {
+	cp         *Crossposter
+	homeserver string
+	token      string
+	client     *http.Client
+	txnID      int64
+	limitOnce  sync.Once
+	maxUpload  int64
+}
+
+func newMatrixSink(cp *Crossposter, cfg CrossposterConfig) *matrixSink {
+	return &matrixSink{
+		cp:         cp,
+		homeserver: strings.TrimRight(cfg.MatrixHomeserver, "/"),
+		token:      cfg.MatrixToken,
+		client:     &http.Client{Timeout: 120 * time.Second},
+	}
+}
+
+func (s *matrixSink) Type() string {
+	return sinkMatrix
+}
+
+func (s *matrixSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := matrixRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", "", false, nil
+	}
+	if s.homeserver == "" || s.token == "" {
+		return "", "", true, userError{code: errNotConfigured}
+	}
+	// the bot posts as the operator's account, so only admins choose the rooms
+	if !s.cp.isUserBotAdmin(c.Sender().ID) {
+		return "", "", true, userError{code: errBotAdminOnly}
+	}
+	// joining works both for room ids and aliases and makes sure we can post there
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	err := s.request("POST", "/_matrix/client/v3/join/"+url.PathEscape(m[1]), "application/json",
+		func() io.Reader { return strings.NewReader("{}") }, &res)
+	if err != nil {
+		log.Printf("Failed to join matrix room %s:\n%s\n", m[1], err.Error())
+		return "", "", true, userError{code: errNoSuchChannel, tgUserOrGroup: m[1]}
+	}
+	return res.RoomID, m[1], true, nil
+}
+
+func (s *matrixSink) Describe(key string) string {
+	return "matrix " + key
+}
+
+// request calls client-server api and decodes response into res.
+// Rate limited requests are retried after the time the server asks to wait.
+func (s *matrixSink) request(method string, apiPath string, contentType string, body func() io.Reader, res interface{}) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		req, err := http.NewRequest(method, s.homeserver+apiPath, body())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		req.Header.Set("Content-Type", contentType)
+		r, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if r.StatusCode != http.StatusOK {
+			var e matrixError
+			json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&e)
+			r.Body.Close()
+			if r.StatusCode == http.StatusTooManyRequests {
+				time.Sleep(time.Duration(e.RetryAfterMs)*time.Millisecond + time.Second)
+				continue
+			}
+			return fmt.Errorf("got status %s: %s %s", r.Status, e.ErrCode, e.Error)
+		}
+		err = json.NewDecoder(r.Body).Decode(res)
+		r.Body.Close()
+		return err
+	}
+	return fmt.Errorf("rate limited")
+}
+
+func (s *matrixSink) sendEvent(room string, content map[string]interface{}) (msgRef, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	txn := fmt.Sprintf("cp%d_%d", time.Now().UnixNano(), atomic.AddInt64(&s.txnID, 1))
+	var res struct {
+		EventID string `json:"event_id"`
+	}
+	err = s.request("PUT", "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/send/m.room.message/"+txn,
+		"application/json", func() io.Reader { return bytes.NewReader(data) }, &res)
+	time.Sleep(time.Second)
+	return msgRef(res.EventID), err
+}
+
+// uploadLimit asks the homeserver for the size limit of uploads once
+func (s *matrixSink) uploadLimit() int64 {
+	s.limitOnce.Do(func() {
+		s.maxUpload = matrixDefaultUploadSize
+		var res struct {
+			Size int64 `json:"m.upload.size"`
+		}
+		err := s.request("GET", "/_matrix/media/v3/config", "application/json",
+			func() io.Reader { return http.NoBody }, &res)
+		if err != nil {
+			log.Printf("Failed to get matrix upload limit:\n%s\n", err.Error())
+			return
+		}
+		if res.Size > 0 {
+			s.maxUpload = res.Size
+		}
+	})
+	return s.maxUpload
+}
+
+// upload puts the file to the media repository and returns its mxc:// uri
+func (s *matrixSink) upload(m mediaItem) (string, string, string, int, error) {
+	r, err := s.client.Get(m.url)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", "", "", 0, fmt.Errorf("got status %s for %s", r.Status, m.url)
+	}
+	limit := s.uploadLimit()
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	if int64(len(data)) > limit {
+		return "", "", "", 0, fmt.Errorf("%s is larger than upload limit of %d bytes", m.url, limit)
+	}
+	mime := r.Header.Get("Content-Type")
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+	name := m.title
+	if name == "" {
+		name = path.Base(r.Request.URL.Path)
+	}
+	var res struct {
+		ContentUri string `json:"content_uri"`
+	}
+	err = s.request("POST", "/_matrix/media/v3/upload?filename="+url.QueryEscape(name), mime,
+		func() io.Reader { return bytes.NewReader(data) }, &res)
+	return res.ContentUri, name, mime, len(data), err
+}
+
+func renderMatrixHTML(text string) string {
+	res := renderInlineLinks(text, html.EscapeString, func(url string, text string) string {
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(text))
+	})
+	return strings.ReplaceAll(res, "\n", "<br>")
+}
+
+func renderMatrixPlain(text string) string {
+	return renderInlineLinks(text, func(s string) string { return s }, func(url string, text string) string {
+		return text + " (" + url + ")"
+	})
+}
+
+func withReply(content map[string]interface{}, replyTo msgRef) map[string]interface{} {
+	if replyTo != "" {
+		content["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]string{"event_id": string(replyTo)},
+		}
+	}
+	return content
+}
+
+func (s *matrixSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	text := strings.Trim(post.text, " \t\n")
+	if len(post.att.links) != 0 {
+		text = strings.TrimLeft(text+"\n"+strings.Join(post.att.links, "\n"), "\n")
+	}
+	if flags&flagAddLinkToPost != 0 && post.Link.rawPostLink != "" {
+		text = strings.TrimLeft(text+"\n\n["+post.Link.rawPostLink+"|"+post.Link.name+"]", "\n")
+	}
+
+	var first msgRef
+	// like in telegram, text is a reply to the previous post in repost chain
+	// and attachments are replies to the text
+	for len(text) > 0 {
+		splitIndex, _ := findIndexToSplit(text, matrixMaxMsgSize)
+		piece := text[:splitIndex]
+		ref, err := s.sendEvent(key, withReply(map[string]interface{}{
+			"msgtype":        "m.text",
+			"body":           renderMatrixPlain(piece),
+			"format":         "org.matrix.custom.html",
+			"formatted_body": renderMatrixHTML(piece),
+		}, replyTo))
+		if err != nil {
+			return first, fmt.Errorf("failed to send text:\n%w", err)
+		}
+		if first == "" {
+			first = ref
+		}
+		replyTo = ref
+		text = strings.TrimLeft(text[splitIndex:], " \t\n")
+	}
+	if first != "" {
+		replyTo = first
+	}
+
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			uri, name, mime, size, err := s.upload(m)
+			if err != nil {
+				log.Printf("Failed to upload %s to matrix:\n%s\n", m.url, err.Error())
+				continue
+			}
+			msgtype := "m.file"
+			switch {
+			case mediaType == mediaAudio:
+				msgtype = "m.audio"
+			case mediaType == mediaPhotoVideo && m.isVideo:
+				msgtype = "m.video"
+			case mediaType == mediaPhotoVideo:
+				msgtype = "m.image"
+			}
+			ref, err := s.sendEvent(key, withReply(map[string]interface{}{
+				"msgtype": msgtype,
+				"body":    name,
+				"url":     uri,
+				"info": map[string]interface{}{
+					"mimetype": mime,
+					"size":     size,
+				},
+			}, replyTo))
+			if err != nil {
+				log.Printf("Failed to send %s for post %s:\n%s\n", msgtype, post.Link.rawPostLink, err.Error())
+				continue
+			}
+			if first == "" {
+				first = ref
+				replyTo = ref
+			}
+		}
+	}
+	return first, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+type matrixRequest struct {
+	method string
+	path   string
+	query  string
+	mime   string
+	body   []byte
+}
+
+// stubHomeserver answers joins, uploads and sent events like a homeserver
+// and serves files under /files/ for sinks to download
+type stubHomeserver struct {
+	mu         sync.Mutex
+	requests   []matrixRequest
+	events     int
+	uploadSize int64 // upload limit, the default one if 0
+}
+
+func (h *stubHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/files/") {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg data"))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "bad token"}`))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, matrixRequest{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Get("Content-Type"), body})
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/join/"):
+		w.Write([]byte(`{"room_id": "!abc:example.org"}`))
+	case r.URL.Path == "/_matrix/media/v3/config" && h.uploadSize != 0:
+		fmt.Fprintf(w, `{"m.upload.size": %d}`, h.uploadSize)
+	case r.URL.Path == "/_matrix/media/v3/upload":
+		w.Write([]byte(`{"content_uri": "mxc://example.org/media1"}`))
+	case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+		h.events++
+		fmt.Fprintf(w, `{"event_id": "$event%d"}`, h.events)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "unknown"}`))
+	}
+}
+
+func (h *stubHomeserver) sentEvents(t *testing.T) []map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := []map[string]interface{}{}
+	for _, r := range h.requests {
+		if r.method != "PUT" || !strings.Contains(r.path, "/send/m.room.message/") {
+			continue
+		}
+		if !strings.HasPrefix(r.path, "/_matrix/client/v3/rooms/%21abc:example.org/send/") {
+			t.Errorf("event is sent to %s", r.path)
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(r.body, &content); err != nil {
+			t.Fatalf("event is not json: %s", err)
+		}
+		res = append(res, content)
+	}
+	return res
+}
+
+func newTestMatrixSink(t *testing.T, admins []int64) (*matrixSink, *stubHomeserver, *httptest.Server) {
+	hs := &stubHomeserver{}
+	srv := httptest.NewServer(hs)
+	t.Cleanup(srv.Close)
+	cp := &Crossposter{botAdmins: admins}
+	return newMatrixSink(cp, CrossposterConfig{MatrixHomeserver: srv.URL + "/", MatrixToken: "token"}), hs, srv
+}
+
+func testContext(t *testing.T, userID int64) tele.Context {
+	bot, err := tele.NewBot(tele.Settings{Offline: true, URL: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot.NewContext(tele.Update{Message: &tele.Message{Sender: &tele.User{ID: userID}, Chat: &tele.Chat{ID: userID}}})
+}
+
+func TestMatrixResolveJoinsRoom(t *testing.T) {
+	s, hs, _ := newTestMatrixSink(t, []int64{1})
+	key, name, ok, err := s.Resolve("matrix:#news:example.org", testContext(t, 1))
+	if err != nil || !ok {
+		t.Fatalf("Resolve returned ok=%v err=%v", ok, err)
+	}
+	if key != "!abc:example.org" || name != "#news:example.org" {
+		t.Errorf("got key %q name %q", key, name)
+	}
+	if len(hs.requests) != 1 || hs.requests[0].method != "POST" || hs.requests[0].path != "/_matrix/client/v3/join/%23news:example.org" {
+		t.Errorf("unexpected requests %+v", hs.requests)
+	}
+}
+
+func TestMatrixResolveAdminOnly(t *testing.T) {
+	s, hs, _ := newTestMatrixSink(t, []int64{1})
+	_, _, ok, err := s.Resolve("matrix:#news:example.org", testContext(t, 2))
+	if e, isUserErr := err.(userError); !ok || !isUserErr || e.code != errBotAdminOnly {
+		t.Errorf("Resolve by non-admin returned ok=%v err=%v", ok, err)
+	}
+	if len(hs.requests) != 0 {
+		t.Errorf("room is joined for non-admin: %+v", hs.requests)
+	}
+	if _, _, ok, _ = s.Resolve("discord:https://example.org", testContext(t, 1)); ok {
+		t.Error("matrix sink accepts discord address")
+	}
+}
+
+func TestMatrixDeliver(t *testing.T) {
+	s, hs, srv := newTestMatrixSink(t, nil)
+	post := &preparedPost{
+		text: "Hello <b> & [https://example.org|site]",
+		Link: postLink{rawPostLink: "https://vk.com/wall1_2", name: "Group"},
+	}
+	post.att.media[mediaPhotoVideo] = []mediaItem{{url: srv.URL + "/files/photo.jpg"}}
+
+	ref, err := s.Deliver("!abc:example.org", post, flagAddLinkToPost, "$previous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "$event1" {
+		t.Errorf("Deliver returned %q, want the text event", ref)
+	}
+	events := hs.sentEvents(t)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want text and image", len(events))
+	}
+
+	text := events[0]
+	if text["msgtype"] != "m.text" || text["format"] != "org.matrix.custom.html" {
+		t.Errorf("unexpected text event %v", text)
+	}
+	wantHTML := `Hello &lt;b&gt; &amp; <a href="https://example.org">site</a><br><br><a href="https://vk.com/wall1_2">Group</a>`
+	if text["formatted_body"] != wantHTML {
+		t.Errorf("formatted_body is\n%v\nwant\n%v", text["formatted_body"], wantHTML)
+	}
+	wantPlain := "Hello <b> & site (https://example.org)\n\nGroup (https://vk.com/wall1_2)"
+	if text["body"] != wantPlain {
+		t.Errorf("body is\n%v\nwant\n%v", text["body"], wantPlain)
+	}
+
+	// text replies to the previous post of the chain, media reply to the text
+	replyOf := func(content map[string]interface{}) interface{} {
+		rel, _ := content["m.relates_to"].(map[string]interface{})
+		inReply, _ := rel["m.in_reply_to"].(map[string]interface{})
+		return inReply["event_id"]
+	}
+	if replyOf(text) != "$previous" {
+		t.Errorf("text replies to %v", replyOf(text))
+	}
+	image := events[1]
+	if replyOf(image) != "$event1" {
+		t.Errorf("image replies to %v", replyOf(image))
+	}
+	if image["msgtype"] != "m.image" || image["url"] != "mxc://example.org/media1" || image["body"] != "photo.jpg" {
+		t.Errorf("unexpected image event %v", image)
+	}
+
+	var upload *matrixRequest
+	for i := range hs.requests {
+		if hs.requests[i].path == "/_matrix/media/v3/upload" {
+			upload = &hs.requests[i]
+		}
+	}
+	if upload == nil {
+		t.Fatal("photo is not uploaded")
+	}
+	if upload.query != "filename=photo.jpg" || upload.mime != "image/jpeg" || string(upload.body) != "jpeg data" {
+		t.Errorf("unexpected upload %+v", *upload)
+	}
+}
+
+func TestMatrixDeliverWithoutReply(t *testing.T) {
+	s, hs, _ := newTestMatrixSink(t, nil)
+	if _, err := s.Deliver("!abc:example.org", &preparedPost{text: "text"}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	events := hs.sentEvents(t)
+	if len(events) != 1 {
+		t.Fatalf("got %d events", len(events))
+	}
+	if _, exists := events[0]["m.relates_to"]; exists {
+		t.Errorf("first post of a chain has a reply: %v", events[0])
+	}
+}
+
+func TestMatrixUploadLimit(t *testing.T) {
+	s, hs, srv := newTestMatrixSink(t, nil)
+	hs.uploadSize = int64(len("jpeg data")) - 1
+	post := &preparedPost{text: "text"}
+	post.att.media[mediaPhotoVideo] = []mediaItem{{url: srv.URL + "/files/photo.jpg"}}
+	if _, err := s.Deliver("!abc:example.org", post, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if events := hs.sentEvents(t); len(events) != 1 {
+		t.Errorf("got %d events, want only text", len(events))
+	}
+	for _, r := range hs.requests {
+		if r.path == "/_matrix/media/v3/upload" {
+			t.Error("file over the limit is uploaded")
+		}
+	}
+}
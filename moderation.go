@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Posts of a moderated subscription are stored in pendingPosts table and
+// sent to the review chat with buttons instead of the destination. Approved
+// posts go on to the destination or the digest, rejected ones are deleted.
+// The reviewer can also reply with a new text of the post. Posts without
+// a decision may be approved or rejected automatically after a timeout.
+// Settings are in moderation table by pubSubID.
+
+const (
+	uniqueApprove = "modApprove"
+	uniqueEdit    = "modEdit"
+	uniqueReject  = "modReject"
+)
+
+var moderationArgsRegex = regexp.MustCompile(`^(\S+)(?:\s+([0-9]{1,3})\s+(approve|reject))?$`)
+
+type pendingPost struct {
+	id        int64
+	pubSubID  int64
+	pubID     int64
+	subID     int64
+	userID    int64
+	chatID    int64
+	msgID     int
+	onTimeout string
+	post      preparedPost
+}
+
+// moderatePosts queues posts for review.
+func (cp *Crossposter) moderatePosts(pubID int64, subID int64, posts []preparedPost) {
+	now := time.Now().Unix()
+	for i := range posts {
+		data, err := marshalPost(&posts[i])
+		if err == nil {
+			_, err = cp.db.Exec(`insert into pendingPosts (pubSubID, post, chatID, msgID, editMsgID, expireAt, onTimeout)
+select pubSub.pubSubID, ?, moderation.reviewChat, 0, 0,
+case when moderation.timeout > 0 then ? + moderation.timeout * 3600 else 0 end, moderation.onTimeout
+from pubSub join moderation on pubSub.pubSubID = moderation.pubSubID where pubID=? and subID=?;`,
+				data, now, pubID, subID)
+		}
+		if err != nil {
+			log.Printf("Failed to queue post %s for review:\n%s\n", posts[i].Link.rawPostLink, err.Error())
+		}
+	}
+	// sending is slow and pubsub is locked now
+	go cp.sendReviews()
+}
+
+func reviewText(lang string, p *pendingPost) string {
+	text := fmt.Sprintf(i18n[lang].reviewPost, p.pubSubID)
+	if p.post.Link.rawPostLink != "" {
+		text += fmt.Sprintf(" <a href='%s'>%s</a>", p.post.Link.rawPostLink, html.EscapeString(p.post.Link.name))
+	}
+	return text
+}
+
+// sendReviews sends posts which are not yet in review chats, those
+// which failed are sent again next time
+func (cp *Crossposter) sendReviews() {
+	cp.moderationMu.Lock()
+	defer cp.moderationMu.Unlock()
+	// there's no user to take the language from
+	lang := "ru"
+	pending, err := cp.loadPendingPosts("pendingPosts.msgID=0")
+	if err != nil {
+		log.Printf("Failed to read posts for review:\n%s\n", err.Error())
+		return
+	}
+	for i := range pending {
+		p := &pending[i]
+		preview := p.post
+		// an edit is shown as a new post, there's nothing to edit in the review chat
+		preview.edited = false
+		cp.forwardPost(&preview, cp.sink(sinkTelegram), strconv.FormatInt(p.chatID, 10), flagAddLinkToPost)
+
+		id := strconv.FormatInt(p.id, 10)
+		markup := &tele.ReplyMarkup{}
+		markup.Inline(markup.Row(
+			markup.Data(i18n[lang].approveButton, uniqueApprove, id),
+			markup.Data(i18n[lang].editButton, uniqueEdit, id),
+			markup.Data(i18n[lang].rejectButton, uniqueReject, id),
+		))
+		msg, err := cp.tgBot.Send(&tele.Chat{ID: p.chatID}, reviewText(lang, p), markup, tele.NoPreview)
+		if err != nil {
+			log.Printf("Failed to send post %d for review to %d:\n%s\n", p.id, p.chatID, err.Error())
+			continue
+		}
+		if _, err = cp.db.Exec("update pendingPosts set msgID=?, editMsgID=0 where id=?;", msg.ID, p.id); err != nil {
+			log.Printf("Failed to save review message of post %d:\n%s\n", p.id, err.Error())
+		}
+	}
+}
+
+// loadPendingPosts returns pending posts matching the condition in the order they came
+func (cp *Crossposter) loadPendingPosts(where string, args ...interface{}) ([]pendingPost, error) {
+	rows, err := cp.db.Query(`select pendingPosts.id, pendingPosts.pubSubID, pubSub.pubID, pubSub.subID, pubSub.userID,
+pendingPosts.chatID, pendingPosts.msgID, pendingPosts.onTimeout, pendingPosts.post from pendingPosts
+join pubSub on pendingPosts.pubSubID = pubSub.pubSubID where `+where+" order by pendingPosts.id;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []pendingPost{}
+	for rows.Next() {
+		var p pendingPost
+		var data string
+		if err = rows.Scan(&p.id, &p.pubSubID, &p.pubID, &p.subID, &p.userID, &p.chatID, &p.msgID, &p.onTimeout, &data); err != nil {
+			return nil, err
+		}
+		if p.post, err = unmarshalPost(data); err != nil {
+			log.Printf("Failed to decode pending post %d:\n%s\n", p.id, err.Error())
+			continue
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+// decide publishes or drops the pending post and marks its review message
+// with status. It returns false if pubsub is stopped and the post stays
+// pending until restart. Must be called with cp.moderationMu locked, so that
+// the post is not decided on twice.
+func (cp *Crossposter) decide(p *pendingPost, approve bool, status string) bool {
+	if approve && !cp.ps.approve(p.pubID, p.subID, []preparedPost{p.post}) {
+		return false
+	}
+	if _, err := cp.db.Exec("delete from pendingPosts where id=?;", p.id); err != nil {
+		log.Printf("Failed to delete pending post %d:\n%s\n", p.id, err.Error())
+	}
+	if p.msgID != 0 {
+		msg := &tele.StoredMessage{MessageID: strconv.Itoa(p.msgID), ChatID: p.chatID}
+		text := reviewText("ru", p) + "\n\n" + status
+		if _, err := cp.tgBot.Edit(msg, text, tele.NoPreview); err != nil {
+			log.Printf("Failed to update review message of post %d:\n%s\n", p.id, err.Error())
+		}
+	}
+	return true
+}
+
+// expireReviews decides on posts which waited for too long
+func (cp *Crossposter) expireReviews() {
+	cp.moderationMu.Lock()
+	defer cp.moderationMu.Unlock()
+	pending, err := cp.loadPendingPosts("pendingPosts.expireAt!=0 and pendingPosts.expireAt<=?", time.Now().Unix())
+	if err != nil {
+		log.Printf("Failed to read expired posts:\n%s\n", err.Error())
+		return
+	}
+	for i := range pending {
+		approve := pending[i].onTimeout == "approve"
+		status := i18n["ru"].rejectedOnTimeout
+		if approve {
+			status = i18n["ru"].approvedOnTimeout
+		}
+		if !cp.decide(&pending[i], approve, status) {
+			return
+		}
+	}
+}
+
+// canReview tells if the user may decide on posts of the subscription:
+// its owner can, and so can admins of the review chat
+func (cp *Crossposter) canReview(p *pendingPost, userID int64) bool {
+	return userID == p.userID || (p.chatID != userID && cp.isUserAdmin(userID, p.chatID))
+}
+
+// findReviewed returns the pending post of the pressed button
+func (cp *Crossposter) findReviewed(c tele.Context) (*pendingPost, error) {
+	id, err := strconv.ParseInt(c.Data(), 10, 64)
+	if err != nil {
+		return nil, userError{code: errInvalidRequest}
+	}
+	pending, err := cp.loadPendingPosts("pendingPosts.id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 || !cp.canReview(&pending[0], c.Sender().ID) {
+		return nil, nil
+	}
+	return &pending[0], nil
+}
+
+func (cp *Crossposter) handleReviewDecision(c tele.Context, approve bool) error {
+	lang := getLang(c)
+	cp.moderationMu.Lock()
+	defer cp.moderationMu.Unlock()
+	p, err := cp.findReviewed(c)
+	if err != nil {
+		return err
+	}
+	status := i18n[lang].postRejected
+	if approve {
+		status = i18n[lang].postApproved
+	}
+	if p == nil || !cp.decide(p, approve, status) {
+		return c.Respond(&tele.CallbackResponse{Text: i18n[lang].postDecided})
+	}
+	return c.Respond()
+}
+
+func (cp *Crossposter) handleApprove(c tele.Context) error {
+	return cp.handleReviewDecision(c, true)
+}
+
+func (cp *Crossposter) handleReject(c tele.Context) error {
+	return cp.handleReviewDecision(c, false)
+}
+
+// handleEditButton asks for the new text, which comes to handleReviewReply
+func (cp *Crossposter) handleEditButton(c tele.Context) error {
+	lang := getLang(c)
+	cp.moderationMu.Lock()
+	defer cp.moderationMu.Unlock()
+	p, err := cp.findReviewed(c)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return c.Respond(&tele.CallbackResponse{Text: i18n[lang].postDecided})
+	}
+	msg, err := cp.tgBot.Send(&tele.Chat{ID: p.chatID}, i18n[lang].editPrompt, &tele.SendOptions{
+		ReplyTo:     c.Message(),
+		ReplyMarkup: &tele.ReplyMarkup{ForceReply: true},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = cp.db.Exec("update pendingPosts set editMsgID=? where id=?;", msg.ID, p.id); err != nil {
+		return err
+	}
+	return c.Respond()
+}
+
+// handleReviewReply replaces the text of the pending post with the reply
+// to the edit prompt and sends the post for review again
+func (cp *Crossposter) handleReviewReply(c tele.Context) error {
+	// the handler gets every text message, only replies to the bot may be prompts
+	reply := c.Message().ReplyTo
+	if reply == nil || reply.Sender == nil || reply.Sender.ID != cp.tgBot.Me.ID {
+		return nil
+	}
+	lang := getLang(c)
+	cp.moderationMu.Lock()
+	pending, err := cp.loadPendingPosts("pendingPosts.chatID=? and pendingPosts.editMsgID=?", c.Chat().ID, reply.ID)
+	if err != nil || len(pending) == 0 || !cp.canReview(&pending[0], c.Sender().ID) {
+		cp.moderationMu.Unlock()
+		return err
+	}
+	p := &pending[0]
+	p.post.text = c.Text()
+	data, err := marshalPost(&p.post)
+	if err == nil {
+		_, err = cp.db.Exec("update pendingPosts set post=?, msgID=0, editMsgID=0 where id=?;", data, p.id)
+	}
+	if err != nil {
+		cp.moderationMu.Unlock()
+		return err
+	}
+	msg := &tele.StoredMessage{MessageID: strconv.Itoa(p.msgID), ChatID: p.chatID}
+	if _, err = cp.tgBot.Edit(msg, reviewText(lang, p)+"\n\n"+i18n[lang].postTextEdited, tele.NoPreview); err != nil {
+		log.Printf("Failed to update review message of post %d:\n%s\n", p.id, err.Error())
+	}
+	cp.moderationMu.Unlock()
+	cp.sendReviews()
+	return nil
+}
+
+// readModeration marks moderated subscriptions
+func (cp *Crossposter) readModeration() error {
+	rows, err := cp.db.Query(`select pubSub.pubID, pubSub.subID from moderation
+join pubSub on moderation.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubID, subID int64
+		if err = rows.Scan(&pubID, &subID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.moderated = true })
+	}
+	return rows.Err()
+}
+
+func (cp *Crossposter) describeModeration(lang string, pubSubID int64) (string, error) {
+	var reviewChat int64
+	var timeout int
+	var onTimeout string
+	err := cp.db.QueryRow("select reviewChat, timeout, onTimeout from moderation where pubSubID=?;", pubSubID).
+		Scan(&reviewChat, &timeout, &onTimeout)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Sprintf(i18n[lang].moderationOff, pubSubID), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	text := fmt.Sprintf(i18n[lang].moderationOn, pubSubID, cp.describeSubscriber(sinkTelegram, strconv.FormatInt(reviewChat, 10)))
+	switch {
+	case timeout > 0 && onTimeout == "approve":
+		text += ", " + fmt.Sprintf(i18n[lang].timeoutApprove, timeout)
+	case timeout > 0:
+		text += ", " + fmt.Sprintf(i18n[lang].timeoutReject, timeout)
+	}
+	return text, nil
+}
+
+func (cp *Crossposter) handleModerate(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.moderateMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	args := strings.TrimSpace(rest)
+	switch args {
+	case "":
+	case "off":
+		// posts already in review can still be decided on
+		if _, err = cp.db.Exec("delete from moderation where pubSubID=?;", pubSubID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.moderated = false })
+	default:
+		m := moderationArgsRegex.FindStringSubmatch(args)
+		if m == nil {
+			return userError{code: errInvalidModeration}
+		}
+		sink, key, _, err := cp.resolveSink(m[1], c)
+		if err != nil {
+			return err
+		}
+		if sink.Type() != sinkTelegram {
+			return userError{code: errInvalidModeration}
+		}
+		timeout, _ := strconv.Atoi(m[2])
+		onTimeout := m[3]
+		if onTimeout == "" {
+			onTimeout = "reject"
+		}
+		_, err = cp.db.Exec("insert or replace into moderation (pubSubID, reviewChat, timeout, onTimeout) values (?, ?, ?, ?);",
+			pubSubID, key, timeout, onTimeout)
+		if err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.moderated = true })
+	}
+	text, err := cp.describeModeration(lang, pubSubID)
+	if err != nil {
+		return err
+	}
+	return c.Send(text)
+}
@@ -2,27 +2,51 @@ package main
 
 import (
 	"sync"
-	"time"
 )
 
 type subscriber struct {
 	feed      chan update
 	subsCount int32
+	schedule  *deliverySchedule // posts are passed to pubsub.hold if set
 }
 
-type subscribersMap = map[int64]uint64
-type vkSource struct {
+// subscription holds settings of a pubSub row
+type subscription struct {
+	flags     uint64
+	settings  *postSettings // nil for defaults
+	filter    *postFilter
+	rewrite   *rewriter
+	template  *postTemplate
+	digest    bool // posts are collected by pubsub.collect instead of being sent
+	moderated bool // posts are passed to pubsub.moderate and sent after approval
+	threshold bool // posts are passed to pubsub.watch and sent once they gain traction
+}
+
+type subscribersMap = map[int64]subscription
+type publisher struct {
+	srcType  string
+	key      string
 	lastPost int64
 	subs     subscribersMap
 }
 
 type pubsub struct {
-	pubToSub    map[int64]vkSource   // vk group id to a list of subscriber ids
+	pubToSub    map[int64]publisher  // publisher id to its source and a list of subscriber ids
 	subscribers map[int64]subscriber // tg channel id to it's vk feed and subCount
 	mu          sync.RWMutex
+	// Hooks are called with mu locked instead of forwarding the posts, so
+	// they must not call back into pubsub. collect, moderate and watch take
+	// posts of subscriptions with digest, moderated and threshold set, hold
+	// takes updates of subscribers with a schedule and returns what to send now.
+	collect  func(pub int64, sub int64, posts []preparedPost)
+	moderate func(pub int64, sub int64, posts []preparedPost)
+	watch    func(pub int64, sub int64, posts []preparedPost)
+	hold     func(sub int64, schedule *deliverySchedule, u update) update
+	stopped  bool
 }
 
-func (ps *pubsub) subscribe(sub int64, pub int64, flags uint64, consumer func(<-chan update)) {
+// pubInstance is only used if the publisher is not yet known
+func (ps *pubsub) subscribe(sub int64, pub int64, pubInstance publisher, flags uint64, consumer func(<-chan update)) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	if _, exists := ps.subscribers[sub]; !exists {
@@ -33,9 +57,10 @@ func (ps *pubsub) subscribe(sub int64, pub int64, flags uint64, consumer func(<-
 	s.subsCount++
 	ps.subscribers[sub] = s
 	if _, exists := ps.pubToSub[pub]; !exists {
-		ps.pubToSub[pub] = vkSource{lastPost: time.Now().Unix(), subs: make(subscribersMap)}
+		pubInstance.subs = make(subscribersMap)
+		ps.pubToSub[pub] = pubInstance
 	}
-	ps.pubToSub[pub].subs[sub] = flags
+	ps.pubToSub[pub].subs[sub] = subscription{flags: flags}
 }
 func (ps *pubsub) addSubscriber(sub int64, consumer func(<-chan update)) {
 	if _, exists := ps.subscribers[sub]; !exists {
@@ -44,7 +69,7 @@ func (ps *pubsub) addSubscriber(sub int64, consumer func(<-chan update)) {
 	}
 
 }
-func (ps *pubsub) addPublisher(pub int64, pubInstnce vkSource) {
+func (ps *pubsub) addPublisher(pub int64, pubInstnce publisher) {
 	if _, exists := ps.pubToSub[pub]; !exists {
 		ps.pubToSub[pub] = pubInstnce
 	}
@@ -54,12 +79,32 @@ func (ps *pubsub) subscribeSimple(sub int64, pub int64, flags uint64) {
 	s := ps.subscribers[sub]
 	s.subsCount++
 	ps.subscribers[sub] = s
-	ps.pubToSub[pub].subs[sub] = flags
+	ps.pubToSub[pub].subs[sub] = subscription{flags: flags}
+}
+
+// updateSubscription changes settings of the subscription with update
+func (ps *pubsub) updateSubscription(sub int64, pub int64, update func(*subscription)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, exists := ps.pubToSub[pub]
+	if !exists {
+		return
+	}
+	s, exists := p.subs[sub]
+	if !exists {
+		return
+	}
+	update(&s)
+	p.subs[sub] = s
 }
 func (ps *pubsub) updateTimeStamp(pubID int64, lastPost int64) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
-	pub := ps.pubToSub[pubID]
+	pub, exists := ps.pubToSub[pubID]
+	if !exists {
+		// unsubscribed while we were fetching updates
+		return
+	}
 	pub.lastPost = lastPost
 	ps.pubToSub[pubID] = pub
 }
@@ -83,14 +128,137 @@ func (ps *pubsub) unsubscribe(sub int64, pub int64) {
 }
 
 func (ps *pubsub) publish(pub int64, msg []preparedPost) {
+	// rules and templates of subscriptions are applied without the lock,
+	// so that a slow one doesn't stop delivery to everyone else
+	ps.mu.RLock()
+	subs := make(subscribersMap, len(ps.pubToSub[pub].subs))
+	for sub, s := range ps.pubToSub[pub].subs {
+		subs[sub] = s
+	}
+	ps.mu.RUnlock()
+	prepared := make(map[int64][]preparedPost, len(subs))
+	for sub, s := range subs {
+		prepared[sub] = s.template.apply(s.rewrite.apply(s.filter.apply(s.settings.apply(msg))))
+	}
+
 	ps.mu.Lock()
-	for sub, flags := range ps.pubToSub[pub].subs {
-		ps.subscribers[sub].feed <- update{msg, flags}
+	defer ps.mu.Unlock()
+	for sub, posts := range prepared {
+		// the subscription may be deleted or changed meanwhile
+		s, exists := ps.pubToSub[pub].subs[sub]
+		if !exists || len(posts) == 0 {
+			continue
+		}
+		if s.threshold {
+			ps.watch(pub, sub, posts)
+			continue
+		}
+		ps.review(pub, sub, s, posts)
+	}
+}
+
+// review passes posts of the subscription to moderation if it's on.
+// Must be called with ps.mu locked.
+func (ps *pubsub) review(pub int64, sub int64, s subscription, posts []preparedPost) {
+	if s.moderated {
+		ps.moderate(pub, sub, posts)
+		return
+	}
+	ps.forward(pub, sub, s, posts)
+}
+
+// forward passes posts of the subscription to its digest or subscriber.
+// Must be called with ps.mu locked.
+func (ps *pubsub) forward(pub int64, sub int64, s subscription, posts []preparedPost) {
+	if s.digest {
+		ps.collect(pub, sub, posts)
+		return
+	}
+	ps.deliver(sub, update{posts, s.flags})
+}
+
+// approve forwards posts which passed moderation, it returns false
+// if pubsub is stopped. Posts of deleted subscriptions are dropped.
+func (ps *pubsub) approve(pub int64, sub int64, posts []preparedPost) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.stopped {
+		return false
+	}
+	if s, exists := ps.pubToSub[pub].subs[sub]; exists {
+		ps.forward(pub, sub, s, posts)
+	}
+	return true
+}
+
+// sendTo sends posts to one subscriber of the publisher as they are,
+// it returns false if there's no such subscription or pubsub is stopped
+func (ps *pubsub) sendTo(pub int64, sub int64, posts []preparedPost) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.stopped {
+		return false
+	}
+	s, exists := ps.pubToSub[pub].subs[sub]
+	if !exists {
+		return false
+	}
+	ps.deliver(sub, update{posts, s.flags})
+	return true
+}
+
+// deliver passes the update to the subscriber unless its schedule holds it.
+// Must be called with ps.mu locked.
+func (ps *pubsub) deliver(sub int64, u update) {
+	s := ps.subscribers[sub]
+	if s.schedule != nil {
+		u = ps.hold(sub, s.schedule, u)
+		if len(u.posts) == 0 {
+			return
+		}
+	}
+	s.feed <- u
+}
+
+// release passes the update held by schedule to the subscriber. It returns
+// false if pubsub is stopped, updates of deleted subscribers are dropped.
+func (ps *pubsub) release(sub int64, u update) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.stopped {
+		return false
+	}
+	if s, exists := ps.subscribers[sub]; exists {
+		s.feed <- u
+	}
+	return true
+}
+
+// engaged passes on posts which reached thresholds of the subscription,
+// it returns false if pubsub is stopped
+func (ps *pubsub) engaged(pub int64, sub int64, posts []preparedPost) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.stopped {
+		return false
+	}
+	if s, exists := ps.pubToSub[pub].subs[sub]; exists {
+		ps.review(pub, sub, s, posts)
+	}
+	return true
+}
+
+func (ps *pubsub) setSchedule(sub int64, schedule *deliverySchedule) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if s, exists := ps.subscribers[sub]; exists {
+		s.schedule = schedule
+		ps.subscribers[sub] = s
 	}
-	ps.mu.Unlock()
 }
 func (ps *pubsub) stopPubSub() {
 	ps.mu.Lock()
+	ps.stopped = true
 	for _, sub := range ps.subscribers {
 		close(sub.feed)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Rewrite rules of a subscription are stored in rewrites table in the form
+// they were typed in /rewrite: "literal" or /regex/ followed by an optional
+// "replacement", which is empty if omitted. Quoted strings are unquoted like
+// in Go, so \" and \n work. Regex replacements may use $1 for groups.
+// Rules are applied in order to the text of the post and its reposts
+// before it's passed to the sink, so sinks split the rewritten text.
+
+var rewriteRuleRegex = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|/(?:[^/\\]|\\.)+/)(?:\s+("(?:[^"\\]|\\.)*"))?$`)
+
+var rewriteArgsRegex = regexp.MustCompile(`^(del\s+([0-9]{1,3})|clear)$`)
+
+type rewriteRule struct {
+	find    string
+	re      *regexp.Regexp
+	replace string
+}
+
+// rewriter is nil for subscriptions without rules
+type rewriter struct {
+	rules []rewriteRule
+}
+
+func parseRewriteRule(raw string) (rewriteRule, error) {
+	var rule rewriteRule
+	m := rewriteRuleRegex.FindStringSubmatch(raw)
+	if m == nil {
+		return rule, fmt.Errorf("invalid rewrite rule %s", raw)
+	}
+	var err error
+	if strings.HasPrefix(m[1], "/") {
+		rule.re, err = regexp.Compile(strings.ReplaceAll(m[1][1:len(m[1])-1], `\/`, "/"))
+	} else {
+		rule.find, err = strconv.Unquote(m[1])
+		if err == nil && rule.find == "" {
+			err = fmt.Errorf("nothing to replace")
+		}
+	}
+	if err != nil {
+		return rule, err
+	}
+	if m[2] != "" {
+		rule.replace, err = strconv.Unquote(m[2])
+	}
+	return rule, err
+}
+
+func newRewriter(rawRules []string) (*rewriter, error) {
+	if len(rawRules) == 0 {
+		return nil, nil
+	}
+	r := &rewriter{}
+	for _, raw := range rawRules {
+		rule, err := parseRewriteRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func (r *rewriter) rewrite(text string) string {
+	for i := range r.rules {
+		if r.rules[i].re != nil {
+			text = r.rules[i].re.ReplaceAllString(text, r.rules[i].replace)
+		} else {
+			text = strings.ReplaceAll(text, r.rules[i].find, r.rules[i].replace)
+		}
+	}
+	return text
+}
+
+// apply returns rewritten copies of posts, the originals
+// are shared by all subscribers of the publisher
+func (r *rewriter) apply(posts []preparedPost) []preparedPost {
+	if r == nil {
+		return posts
+	}
+	res := make([]preparedPost, len(posts))
+	for i := range posts {
+		res[i] = posts[i]
+		res[i].text = r.rewrite(posts[i].text)
+		if posts[i].copyHistory != nil {
+			res[i].copyHistory = r.apply(posts[i].copyHistory)
+		}
+	}
+	return res
+}
+
+// readRewrites sets rewrite rules of subscriptions read from db
+func (cp *Crossposter) readRewrites() error {
+	return cp.readSubscriptionRules("rewrites", func(pubSubID int64, pubID int64, subID int64, rules []string) {
+		rewrite, err := newRewriter(rules)
+		if err != nil {
+			log.Printf("Invalid rewrite rules of pubSub %d, they are ignored:\n%s\n", pubSubID, err.Error())
+			return
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.rewrite = rewrite })
+	})
+}
+
+func (cp *Crossposter) handleRewrite(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.rewriteMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	args := strings.TrimSpace(rest)
+	if m := rewriteArgsRegex.FindStringSubmatch(args); m != nil {
+		if m[1] == "clear" {
+			_, err = cp.db.Exec("delete from rewrites where pubSubID=?;", pubSubID)
+		} else {
+			n, _ := strconv.Atoi(m[2])
+			if n == 0 {
+				return userError{code: errInvalidRequest}
+			}
+			_, err = cp.db.Exec(`delete from rewrites where rowid =
+(select rowid from rewrites where pubSubID=? order by rowid limit 1 offset ?);`, pubSubID, n-1)
+		}
+	} else if args != "" {
+		if _, err = parseRewriteRule(args); err != nil {
+			return userError{code: errInvalidRewrite, vkUserOrGroup: args}
+		}
+		_, err = cp.db.Exec("insert into rewrites (pubSubID, rule) values (?, ?);", pubSubID, args)
+	}
+	if err != nil {
+		return err
+	}
+
+	rules, err := cp.loadSubscriptionRules("rewrites", pubSubID)
+	if err != nil {
+		return err
+	}
+	rewrite, err := newRewriter(rules)
+	if err != nil {
+		return err
+	}
+	cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.rewrite = rewrite })
+	if len(rules) == 0 {
+		return c.Send(fmt.Sprintf(i18n[lang].noRewrites, pubSubID))
+	}
+	list := ""
+	for i, rule := range rules {
+		list += fmt.Sprintf("%d. %s\n", i+1, html.EscapeString(rule))
+	}
+	return c.Send(fmt.Sprintf(i18n[lang].rewriteList, pubSubID, list))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkRss = "rss"
+
+// there's only one rss subscriber, subscribing a publisher to it
+// allows to serve its feed
+const rssKey = "rss"
+
+// how many latest posts are kept and served for every feed
+const rssFeedSize = 50
+
+var rssRegex = regexp.MustCompile(`^rss$`)
+
+// served feeds are plain RSS 2.0, parsed ones are in feedSource.go
+type servedRssItem struct {
+	Title       string         `xml:"title"`
+	Link        string         `xml:"link,omitempty"`
+	Guid        string         `xml:"guid"`
+	PubDate     string         `xml:"pubDate"`
+	Description string         `xml:"description"`
+	Enclosures  []rssEnclosure `xml:"enclosure"`
+}
+
+type servedRssChannel struct {
+	Title       string          `xml:"title"`
+	Link        string          `xml:"link"`
+	Description string          `xml:"description"`
+	Items       []servedRssItem `xml:"item"`
+}
+
+type servedRssDocument struct {
+	XMLName xml.Name         `xml:"rss"`
+	Version string           `xml:"version,attr"`
+	Channel servedRssChannel `xml:"channel"`
+}
+
+// rssSink turns vk walls into rss feeds served at /feed/<screen-name>.xml.
+// Posts delivered to it are kept in memory, so after restart feeds
+// are empty until new posts appear. Feeds of publishers which aren't
+// subscribed to rss sink are not served.
+type rssSink struct {
+	cp    *Crossposter
+	mu    sync.RWMutex
+	posts map[int][]preparedPost // vk owner id to its latest posts, oldest first
+	ids   CacheMap[string, int64]
+}
+
+func newRssSink(cp *Crossposter) *rssSink {
+	s := &rssSink{
+		cp:    cp,
+		posts: make(map[int][]preparedPost),
+		ids:   NewCacheMap[string, int64](1000),
+	}
+	if cp.httpMux != nil {
+		cp.httpMux.HandleFunc("/feed/", s.handle)
+	}
+	return s
+}
+
+func (s *rssSink) Type() string {
+	return sinkRss
+}
+
+func (s *rssSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	if !rssRegex.MatchString(addr) {
+		return "", "", false, nil
+	}
+	if s.cp.httpServer == nil {
+		return "", "", true, userError{code: errHttpDisabled}
+	}
+	return rssKey, "rss " + s.cp.httpBaseUrl + "/feed/", true, nil
+}
+
+func (s *rssSink) Describe(key string) string {
+	return "rss " + s.cp.httpBaseUrl + "/feed/"
+}
+
+func (s *rssSink) deliversCopyHistory() {}
+
+func (s *rssSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	if !strings.HasPrefix(post.Link.rawPostLink, "https://vk.com/") {
+		return "", fmt.Errorf("only vk posts can be served as rss")
+	}
+	if name, err := s.cp.vkScreenNameById(int64(post.ownerID)); err == nil {
+		s.ids.Put(strings.ToLower(name), int64(post.ownerID), approxNDaysFromNow(2))
+	}
+	s.mu.Lock()
+	posts := append(s.posts[post.ownerID], *post)
+	if len(posts) > rssFeedSize {
+		posts = posts[len(posts)-rssFeedSize:]
+	}
+	s.posts[post.ownerID] = posts
+	s.mu.Unlock()
+	return msgRef(post.Link.rawPostLink), nil
+}
+
+// feedOwner finds the wall served at name among publishers subscribed to
+// rss. Names are matched against screen names of those walls only, so
+// requests for other names never reach vk api.
+func (s *rssSink) feedOwner(name string) (int64, bool, error) {
+	if id, ok := s.ids.Get(name); ok {
+		served, err := s.whitelisted(id)
+		return id, served, err
+	}
+	rows, err := s.cp.db.Query(`select distinct publishers.key from pubSub
+join publishers on pubSub.pubID=publishers.id
+join subscribers on pubSub.subID=subscribers.id
+where publishers.type=? and subscribers.type=?;`, sourceVkWall, sinkRss)
+	if err != nil {
+		return 0, false, err
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		if id, err := strconv.ParseInt(key, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, false, err
+	}
+	for _, id := range ids {
+		// walls without screen names are at vk.com/id1 and vk.com/club1
+		names := []string{fmt.Sprintf("id%d", id)}
+		if id < 0 {
+			names = []string{fmt.Sprintf("club%d", -id), fmt.Sprintf("public%d", -id)}
+		}
+		if screenName, err := s.cp.vkScreenNameById(id); err == nil && screenName != "" {
+			names = append(names, strings.ToLower(screenName))
+		}
+		for _, n := range names {
+			if n == name {
+				s.ids.Put(name, id, approxNDaysFromNow(2))
+				return id, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+func (s *rssSink) whitelisted(ownerID int64) (bool, error) {
+	var n int
+	err := s.cp.db.QueryRow(`select count(*) from pubSub
+join publishers on pubSub.pubID=publishers.id
+join subscribers on pubSub.subID=subscribers.id
+where publishers.type=? and publishers.key=? and subscribers.type=?;`,
+		sourceVkWall, strconv.FormatInt(ownerID, 10), sinkRss).Scan(&n)
+	return n > 0, err
+}
+
+func (s *rssSink) handle(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/feed/")
+	if !strings.HasSuffix(name, ".xml") || !vkWallRegex.MatchString("vk.com/"+strings.TrimSuffix(name, ".xml")) {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, ".xml"))
+	id, ok, err := s.feedOwner(name)
+	if err != nil {
+		log.Printf("Failed to check if feed of %s is served:\n%s\n", name, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	title := "vk.com/" + name
+	if vkName, err := s.cp.vkNameById(id); err == nil {
+		title = vkName
+	}
+	doc := servedRssDocument{
+		Version: "2.0",
+		Channel: servedRssChannel{
+			Title:       title,
+			Link:        "https://vk.com/" + name,
+			Description: fmt.Sprintf(i18n["ru"].rssDescription, name),
+			Items:       []servedRssItem{},
+		},
+	}
+	s.mu.RLock()
+	posts := s.posts[int(id)]
+	for i := len(posts) - 1; i >= 0; i-- {
+		doc.Channel.Items = append(doc.Channel.Items, makeRssItem(&posts[i]))
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err = enc.Encode(doc); err != nil {
+		log.Printf("Failed to write feed of %s:\n%s\n", name, err.Error())
+	}
+}
+
+// rssDescription renders the post with the reposted chain as nested quotes.
+// Reposted posts get links to them, the link of the item is the post itself.
+func rssDescription(post *preparedPost, chain []preparedPost, addLink bool) string {
+	var b strings.Builder
+	text := renderInlineLinks(strings.Trim(post.text, " \t\n"), html.EscapeString, func(url string, text string) string {
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(text))
+	})
+	b.WriteString("<p>" + strings.ReplaceAll(text, "\n", "<br>\n") + "</p>\n")
+	for _, l := range post.att.links {
+		b.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(l), html.EscapeString(l)))
+	}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			if mediaType == mediaPhotoVideo && !m.isVideo {
+				b.WriteString(fmt.Sprintf("<p><img src=\"%s\"></p>\n", html.EscapeString(m.url)))
+			} else {
+				b.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(m.url), html.EscapeString(mediaLinkText(m))))
+			}
+		}
+	}
+	if len(chain) > 0 {
+		b.WriteString("<blockquote>\n" + rssDescription(&chain[len(chain)-1], chain[:len(chain)-1], true) + "</blockquote>\n")
+	}
+	if addLink && post.Link.rawPostLink != "" {
+		b.WriteString(fmt.Sprintf("<p><a href=\"%s\">%s</a></p>\n",
+			html.EscapeString(post.Link.rawPostLink), html.EscapeString(post.Link.name)))
+	}
+	return b.String()
+}
+
+func makeRssItem(post *preparedPost) servedRssItem {
+	date := post.date
+	if date == 0 {
+		date = time.Now().Unix()
+	}
+	item := servedRssItem{
+		Title:       archiveTitle(post),
+		Link:        post.Link.rawPostLink,
+		Guid:        post.Link.rawPostLink,
+		PubDate:     time.Unix(date, 0).UTC().Format(time.RFC1123Z),
+		Description: rssDescription(post, post.copyHistory, false),
+	}
+	for _, m := range post.att.media[mediaPhotoVideo] {
+		if !m.isVideo {
+			item.Enclosures = append(item.Enclosures, rssEnclosure{Url: m.url, Type: "image/jpeg"})
+		}
+	}
+	return item
+}
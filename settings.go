@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Settings of a subscription decide which kinds of posts it takes: posts by
+// other authors on the wall, reposts, ads, pinned and VK Donut posts. They
+// are in postSettings table by pubSubID, groups whose posts shouldn't be
+// reposted are rules of blockedReposts table. Publishers are shared by
+// subscriptions, so posts are fetched with wall.get filter=all and
+// filter=owner is done here by the author of the post.
+
+type postSettings struct {
+	ownerOnly bool
+	reposts   bool
+	ads       bool
+	pinned    bool
+	donut     bool
+	blocked   map[int]bool // owner ids of walls whose posts aren't taken as reposts
+}
+
+// defaultPostSettings are used by subscriptions without settings
+var defaultPostSettings = postSettings{reposts: true, pinned: true, donut: true}
+
+func (s *postSettings) allows(post *preparedPost) bool {
+	if s == nil {
+		s = &defaultPostSettings
+	}
+	switch {
+	case post.ad && !s.ads:
+		return false
+	case post.pinned && !s.pinned:
+		return false
+	case post.donut && !s.donut:
+		return false
+	case s.ownerOnly && post.fromID != 0 && post.fromID != post.ownerID:
+		return false
+	case len(post.copyHistory) > 0 && !s.reposts:
+		return false
+	}
+	for i := range post.copyHistory {
+		if s.blocked[post.copyHistory[i].ownerID] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns posts allowed by settings, nil settings are the defaults
+func (s *postSettings) apply(posts []preparedPost) []preparedPost {
+	res := make([]preparedPost, 0, len(posts))
+	for i := range posts {
+		if s.allows(&posts[i]) {
+			res = append(res, posts[i])
+		}
+	}
+	return res
+}
+
+func onOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
+
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is neither on nor off", s)
+}
+
+func (cp *Crossposter) loadPostSettings(pubSubID int64) (*postSettings, error) {
+	s := defaultPostSettings
+	err := cp.db.QueryRow("select ownerOnly, reposts, ads, pinned, donut from postSettings where pubSubID=?;", pubSubID).
+		Scan(&s.ownerOnly, &s.reposts, &s.ads, &s.pinned, &s.donut)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	blocked, err := cp.loadSubscriptionRules("blockedReposts", pubSubID)
+	if err != nil {
+		return nil, err
+	}
+	s.blocked = parseBlocked(blocked)
+	return &s, nil
+}
+
+func parseBlocked(rules []string) map[int]bool {
+	blocked := make(map[int]bool, len(rules))
+	for _, rule := range rules {
+		id, err := strconv.Atoi(rule)
+		if err != nil {
+			log.Printf("Invalid blocked repost source %s\n", rule)
+			continue
+		}
+		blocked[id] = true
+	}
+	return blocked
+}
+
+// readPostSettings sets settings of subscriptions read from db
+func (cp *Crossposter) readPostSettings() error {
+	rows, err := cp.db.Query(`select pubSub.pubSubID, pubSub.pubID, pubSub.subID from postSettings
+join pubSub on postSettings.pubSubID = pubSub.pubSubID
+union select pubSub.pubSubID, pubSub.pubID, pubSub.subID from blockedReposts
+join pubSub on blockedReposts.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		return err
+	}
+	type subRef struct{ pubSubID, pubID, subID int64 }
+	refs := []subRef{}
+	for rows.Next() {
+		var ref subRef
+		if err = rows.Scan(&ref.pubSubID, &ref.pubID, &ref.subID); err != nil {
+			rows.Close()
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		settings, err := cp.loadPostSettings(ref.pubSubID)
+		if err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(ref.subID, ref.pubID, func(s *subscription) { s.settings = settings })
+	}
+	return nil
+}
+
+// publishersWithAds returns ids of publishers having a subscription that
+// takes ads, the others get ads dropped by vk execute
+func (cp *Crossposter) publishersWithAds() (map[int64]bool, error) {
+	rows, err := cp.db.Query(`select distinct pubSub.pubID from postSettings
+join pubSub on postSettings.pubSubID = pubSub.pubSubID where postSettings.ads;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res[id] = true
+	}
+	return res, rows.Err()
+}
+
+func (cp *Crossposter) describePostSettings(lang string, pubSubID int64, s *postSettings) string {
+	blocked := []string{}
+	for id := range s.blocked {
+		name, err := cp.vkScreenNameById(int64(id))
+		if err != nil {
+			name = "[DELETED]"
+		} else {
+			name = "vk.com/" + name
+		}
+		blocked = append(blocked, name)
+	}
+	blockedList := i18n[lang].nothingBlocked
+	if len(blocked) > 0 {
+		blockedList = strings.Join(blocked, ", ")
+	}
+	return fmt.Sprintf(i18n[lang].settingsList, pubSubID,
+		onOff(s.ownerOnly), onOff(s.reposts), onOff(s.ads), onOff(s.pinned), onOff(s.donut), blockedList)
+}
+
+func (cp *Crossposter) handleSettings(c tele.Context) error {
+	pubSubID, pubID, subID, rest, err := cp.findOwnedPubSub(c, cp.settingsMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+	settings, err := cp.loadPostSettings(pubSubID)
+	if err != nil {
+		return err
+	}
+
+	// check everything before changes are saved
+	args := strings.Fields(rest)
+	if len(args)%2 != 0 {
+		return userError{code: errInvalidSettings}
+	}
+	block, unblock := []string{}, []string{}
+	for i := 0; i < len(args); i += 2 {
+		key, value := args[i], args[i+1]
+		if key == "block" || key == "unblock" {
+			name := value
+			if m := vkWallRegex.FindStringSubmatch(value); m != nil {
+				name = m[1]
+			}
+			id, err := cp.resolveVkName(name)
+			if err != nil {
+				return err
+			}
+			if key == "block" {
+				block = append(block, strconv.FormatInt(id, 10))
+			} else {
+				unblock = append(unblock, strconv.FormatInt(id, 10))
+			}
+			continue
+		}
+		v, err := parseOnOff(value)
+		if err != nil {
+			return userError{code: errInvalidSettings}
+		}
+		switch key {
+		case "owner":
+			settings.ownerOnly = v
+		case "reposts":
+			settings.reposts = v
+		case "ads":
+			settings.ads = v
+		case "pinned":
+			settings.pinned = v
+		case "donut":
+			settings.donut = v
+		default:
+			return userError{code: errInvalidSettings}
+		}
+	}
+
+	if len(args) > 0 {
+		_, err = cp.db.Exec("insert or replace into postSettings (pubSubID, ownerOnly, reposts, ads, pinned, donut) values (?, ?, ?, ?, ?, ?);",
+			pubSubID, settings.ownerOnly, settings.reposts, settings.ads, settings.pinned, settings.donut)
+		for _, id := range block {
+			if err == nil {
+				_, err = cp.db.Exec("insert or ignore into blockedReposts (pubSubID, rule) values (?, ?);", pubSubID, id)
+			}
+		}
+		for _, id := range unblock {
+			if err == nil {
+				_, err = cp.db.Exec("delete from blockedReposts where pubSubID=? and rule=?;", pubSubID, id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if settings, err = cp.loadPostSettings(pubSubID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.settings = settings })
+	}
+	return c.Send(cp.describePostSettings(lang, pubSubID, settings))
+}
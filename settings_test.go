@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublishersWithAds(t *testing.T) {
+	cp := newTestCrossposter(t)
+	_, err := cp.db.Exec(`insert into pubSub (pubSubID, pubID, subID) values (1, 10, 1), (2, 10, 2), (3, 20, 1), (4, 30, 1);
+insert into postSettings (pubSubID, ownerOnly, reposts, ads, pinned, donut) values (1, 0, 1, 0, 1, 1), (2, 0, 1, 1, 1, 1), (3, 0, 1, 0, 1, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withAds, err := cp.publishersWithAds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withAds) != 1 || !withAds[10] {
+		t.Errorf("publishers with ads are %v, want only the one with a subscription taking them", withAds)
+	}
+
+	objects := makeObjects([]vkReqData{{id: 10, owner: -1, ads: true}, {id: 20, owner: -2}})
+	if !strings.Contains(objects, `"owner":-1, "lastPost": 0, "ads": true}`) || !strings.Contains(objects, `"owner":-2, "lastPost": 0, "ads": false}`) {
+		t.Errorf("unexpected batch %s", objects)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Sinks deliver prepared posts to subscribers. Like publishers, every row of
+// the subscribers table has a sink type and an opaque key which only
+// the sink of that type can interpret, e.g. chat id for telegram.
+
+// msgRef identifies a delivered message within a sink, so that
+// the next post of a repost chain can reply to it.
+// Empty ref means there's nothing to reply to.
+type msgRef string
+
+type Sink interface {
+	// Type is stored in subscribers.type and selects the sink for a row
+	Type() string
+	// Resolve parses the destination passed to /add by the sender of c.
+	// It returns the key and display name of the destination, ok == false
+	// if the address belongs to some other sink, and userError if it's ours
+	// but the user can't subscribe it.
+	Resolve(addr string, c tele.Context) (key string, name string, ok bool, err error)
+	// Describe returns human readable name of the destination for /ls
+	Describe(key string) string
+	// Deliver sends a single post, not including its copy history,
+	// as a reply to replyTo if it's not empty. It returns a reference
+	// to the first sent message or an empty ref if nothing was sent.
+	Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error)
+}
+
+// Sinks which hold posts back, like digests, implement flusher
+// to send what they have when the bot shuts down
+type flusher interface {
+	Flush()
+}
+
+// Sinks with periodic work, like sending digests, implement scheduledSink.
+// runJobs is called every minute by scheduled jobs, never after Stop.
+type scheduledSink interface {
+	runJobs(now time.Time)
+}
+
+// Sinks which take a post with its copy history in one Deliver call
+// instead of a call for every post of the chain implement chainSink
+type chainSink interface {
+	deliversCopyHistory()
+}
+
+// Sinks which can change delivered posts implement editingSink.
+// Edits of posts are not delivered to other sinks.
+type editingSink interface {
+	// Edit finds what was delivered for post by its link and updates it
+	Edit(key string, post *preparedPost, flags uint64) error
+}
+
+func (cp *Crossposter) sink(sinkType string) Sink {
+	for _, s := range cp.sinks {
+		if s.Type() == sinkType {
+			return s
+		}
+	}
+	return nil
+}
+
+// resolveSink finds the sink which accepts the destination
+// given to /add and returns it along with the subscriber key and name
+func (cp *Crossposter) resolveSink(addr string, c tele.Context) (Sink, string, string, error) {
+	for _, s := range cp.sinks {
+		key, name, ok, err := s.Resolve(addr, c)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+		return s, key, name, nil
+	}
+	return nil, "", "", userError{code: errInvalidRequest}
+}
+
+func (cp *Crossposter) describeSubscriber(sinkType string, key string) string {
+	s := cp.sink(sinkType)
+	if s == nil {
+		return fmt.Sprintf("[%s %s]", sinkType, key)
+	}
+	return s.Describe(key)
+}
+
+func (cp *Crossposter) newConsumer(sinkType string, key string) func(<-chan update) {
+	s := cp.sink(sinkType)
+	return func(ch <-chan update) {
+		cp.listenAndForward(ch, s, key)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Every row of the publishers table has a source type and an opaque key.
+// Only the source of that type knows what the key means: for vk walls it's
+// the owner id, for other sources it may be an url or anything else.
+// The cursor is stored in publishers.lastPost and is also opaque to the rest
+// of the bot, most sources use a unix time of the latest seen post.
+
+type publisherRef struct {
+	id     int64
+	key    string
+	cursor int64
+}
+
+type sourceUpdate struct {
+	pubID  int64
+	cursor int64
+	posts  []preparedPost
+}
+
+type Source interface {
+	// Type is stored in publishers.type and selects the source for a row
+	Type() string
+	// Resolve parses the address passed to /add by the sender of c.
+	// It returns ok == false if the address belongs to some other source,
+	// and userError if it's ours but can't be subscribed to.
+	Resolve(addr string, c tele.Context) (key string, ok bool, err error)
+	// Describe returns human readable address of the publisher for /ls
+	Describe(key string) string
+	// InitialCursor is the cursor of a newly added publisher, so that
+	// old posts are not sent to new subscribers.
+	InitialCursor(key string) int64
+	// Poll is called every UpdatePeriod with all publishers of this type.
+	// It fetches posts newer than the cursor and passes them to emit as soon
+	// as they're ready. Sources which receive posts by themselves
+	// call Crossposter.publish instead and do nothing in Poll.
+	Poll(pubs []publisherRef, emit func(sourceUpdate))
+}
+
+func (cp *Crossposter) source(srcType string) Source {
+	for _, src := range cp.sources {
+		if src.Type() == srcType {
+			return src
+		}
+	}
+	return nil
+}
+
+// resolveSource finds the source which accepts the address
+// given to /add and returns it along with the publisher key
+func (cp *Crossposter) resolveSource(addr string, c tele.Context) (Source, string, error) {
+	for _, src := range cp.sources {
+		key, ok, err := src.Resolve(addr, c)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return src, key, nil
+	}
+	return nil, "", userError{code: errInvalidRequest}
+}
+
+func (cp *Crossposter) describePublisher(srcType string, key string) string {
+	src := cp.source(srcType)
+	if src == nil {
+		return fmt.Sprintf("[%s %s]", srcType, key)
+	}
+	return src.Describe(key)
+}
+
+func (cp *Crossposter) publish(pubID int64, posts []preparedPost) {
+	if len(posts) == 0 {
+		return
+	}
+	cp.stats.addUpdate(updateInfo{
+		time.Now().Unix(),
+		len(posts),
+	})
+	cp.ps.publish(pubID, posts)
+}
+
+func (cp *Crossposter) pollSources() {
+	bySource := make(map[string][]publisherRef)
+	cp.ps.mu.RLock()
+	for id, pub := range cp.ps.pubToSub {
+		bySource[pub.srcType] = append(bySource[pub.srcType], publisherRef{
+			id:     id,
+			key:    pub.key,
+			cursor: pub.lastPost,
+		})
+	}
+	cp.ps.mu.RUnlock()
+
+	for srcType, pubs := range bySource {
+		src := cp.source(srcType)
+		if src == nil {
+			log.Printf("No source for type %s, %d publishers are not polled\n", srcType, len(pubs))
+			continue
+		}
+		src.Poll(pubs, func(u sourceUpdate) {
+			cp.updateTimeStamp(u.pubID, u.cursor)
+			cp.publish(u.pubID, u.posts)
+		})
+	}
+}
+
+func (cp *Crossposter) startCrossposting() {
+	for {
+		cp.pollSources()
+		cp.checkEngagement()
+		select {
+		case <-cp.chDone:
+			return
+		case <-time.After(cp.updatePeriod):
+			continue
+		}
+	}
+}
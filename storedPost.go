@@ -0,0 +1,104 @@
+package main
+
+import "encoding/json"
+
+// storedPost is preparedPost with exported fields, so that posts
+// waiting for delivery can be kept in db as json
+
+type storedMedia struct {
+	Url       string `json:"url,omitempty"`
+	IsVideo   bool   `json:"is_video,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Performer string `json:"performer,omitempty"`
+	TgFileID  string `json:"tg_file_id,omitempty"`
+}
+
+type storedPost struct {
+	Media       [nMediaTypes][]storedMedia `json:"media"`
+	Links       []string                   `json:"links,omitempty"`
+	OwnerID     int                        `json:"owner_id"`
+	ID          int                        `json:"id"`
+	Date        int64                      `json:"date,omitempty"`
+	Edited      bool                       `json:"edited,omitempty"`
+	AlwaysLink  bool                       `json:"always_link,omitempty"`
+	Text        string                     `json:"text"`
+	Author      string                     `json:"author,omitempty"`
+	FromID      int                        `json:"from_id,omitempty"`
+	Ad          bool                       `json:"ad,omitempty"`
+	Pinned      bool                       `json:"pinned,omitempty"`
+	Donut       bool                       `json:"donut,omitempty"`
+	CopyHistory []storedPost               `json:"copy_history,omitempty"`
+	Link        string                     `json:"link,omitempty"`
+	Name        string                     `json:"name,omitempty"`
+}
+
+func makeStoredPost(post *preparedPost) storedPost {
+	res := storedPost{
+		Links:      post.att.links,
+		OwnerID:    post.ownerID,
+		ID:         post.ID,
+		Date:       post.date,
+		Edited:     post.edited,
+		AlwaysLink: post.alwaysLink,
+		Text:       post.text,
+		Author:     post.author,
+		FromID:     post.fromID,
+		Ad:         post.ad,
+		Pinned:     post.pinned,
+		Donut:      post.donut,
+		Link:       post.Link.rawPostLink,
+		Name:       post.Link.name,
+	}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			res.Media[mediaType] = append(res.Media[mediaType], storedMedia{m.url, m.isVideo, m.title, m.performer, m.tgFileID})
+		}
+	}
+	for i := range post.copyHistory {
+		res.CopyHistory = append(res.CopyHistory, makeStoredPost(&post.copyHistory[i]))
+	}
+	return res
+}
+
+func (s *storedPost) prepared() preparedPost {
+	post := preparedPost{
+		att:        preparedAttachments{preparedMedia{}, s.Links},
+		ownerID:    s.OwnerID,
+		ID:         s.ID,
+		date:       s.Date,
+		edited:     s.Edited,
+		alwaysLink: s.AlwaysLink,
+		text:       s.Text,
+		author:     s.Author,
+		fromID:     s.FromID,
+		ad:         s.Ad,
+		pinned:     s.Pinned,
+		donut:      s.Donut,
+		Link:       postLink{s.Link, s.Name},
+	}
+	if post.att.links == nil {
+		post.att.links = []string{}
+	}
+	for mediaType := range s.Media {
+		for _, m := range s.Media[mediaType] {
+			post.att.media[mediaType] = append(post.att.media[mediaType], mediaItem{m.Url, m.IsVideo, m.Title, m.Performer, m.TgFileID})
+		}
+	}
+	for i := range s.CopyHistory {
+		post.copyHistory = append(post.copyHistory, s.CopyHistory[i].prepared())
+	}
+	return post
+}
+
+func marshalPost(post *preparedPost) (string, error) {
+	data, err := json.Marshal(makeStoredPost(post))
+	return string(data), err
+}
+
+func unmarshalPost(data string) (preparedPost, error) {
+	var s storedPost
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return preparedPost{}, err
+	}
+	return s.prepared(), nil
+}
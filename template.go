@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// A template of a subscription replaces the text of every post and repost
+// with the result of text/template executed on templatePost. The result is
+// still in our text model with [url|text] links, so sinks split and render
+// it like any other text and message limits are respected.
+
+// rendered text longer than this is a broken template
+const maxTemplateOutput = 64 * 1024
+
+type templatePost struct {
+	Text       string
+	SourceName string
+	SourceURL  string
+	Author     string
+	Date       time.Time // zero if unknown
+	Depth      int       // 0 for the post itself, 1 for the post it reposts and so on
+}
+
+var templateFuncs = template.FuncMap{
+	// link makes an inline link of our text model
+	"link": func(url string, text string) string {
+		if url == "" {
+			return text
+		}
+		if text == "" {
+			text = url
+		}
+		return "[" + url + "|" + strings.NewReplacer("[", "(", "]", ")", "|", "/").Replace(text) + "]"
+	},
+}
+
+// allowedTemplateFuncs can't make rendering slow, printf is missing
+// because a large width allocates any amount of memory
+var allowedTemplateFuncs = map[string]bool{
+	"link": true, "and": true, "or": true, "not": true, "len": true, "index": true, "slice": true, "print": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+}
+
+// checkTemplateNode rejects loops, nested templates and unknown functions.
+// Templates run for every post, and {{range 100000000000}}{{end}} would
+// never finish without writing anything.
+func checkTemplateNode(node parse.Node) error {
+	switch n := node.(type) {
+	case nil, *parse.TextNode, *parse.CommentNode, *parse.FieldNode, *parse.VariableNode, *parse.DotNode,
+		*parse.NilNode, *parse.BoolNode, *parse.NumberNode, *parse.StringNode:
+		return nil
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplateNode(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parse.ActionNode:
+		return checkTemplateNode(n.Pipe)
+	case *parse.IfNode:
+		return checkBranchNode(&n.BranchNode)
+	case *parse.WithNode:
+		return checkBranchNode(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := checkTemplateNode(cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if err := checkTemplateNode(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parse.ChainNode:
+		return checkTemplateNode(n.Node)
+	case *parse.IdentifierNode:
+		if !allowedTemplateFuncs[n.Ident] {
+			return fmt.Errorf("function %s is not allowed", n.Ident)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not allowed", node)
+}
+
+func checkBranchNode(n *parse.BranchNode) error {
+	for _, child := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := checkTemplateNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type postTemplate struct {
+	tmpl *template.Template
+}
+
+// limitedBuilder stops the template from producing endless output
+type limitedBuilder struct {
+	strings.Builder
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateOutput {
+		return 0, fmt.Errorf("template output is longer than %d bytes", maxTemplateOutput)
+	}
+	return b.Builder.Write(p)
+}
+
+func newPostTemplate(text string) (*postTemplate, error) {
+	tmpl, err := template.New("post").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, fmt.Errorf("define and block are not allowed")
+	}
+	if err = checkTemplateNode(tmpl.Tree.Root); err != nil {
+		return nil, err
+	}
+	t := &postTemplate{tmpl}
+	// catch references to unknown fields before the template is saved
+	_, err = t.render(&preparedPost{text: "text", Link: postLink{"https://vk.com/wall1_1", "name"}}, 0)
+	return t, err
+}
+
+func (t *postTemplate) render(post *preparedPost, depth int) (string, error) {
+	data := templatePost{
+		Text:       post.text,
+		SourceName: post.Link.name,
+		SourceURL:  post.Link.rawPostLink,
+		Author:     post.author,
+		Depth:      depth,
+	}
+	if post.date != 0 {
+		data.Date = time.Unix(post.date, 0)
+	}
+	var b limitedBuilder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (t *postTemplate) renderPost(post *preparedPost, depth int) preparedPost {
+	res := *post
+	// empty reposts are not sent, the template shouldn't change that
+	if strings.TrimSpace(post.text) != "" || !post.att.Empty() {
+		text, err := t.render(post, depth)
+		if err != nil {
+			log.Printf("Failed to render template for post %s, original text is used:\n%s\n", post.Link.rawPostLink, err.Error())
+		} else {
+			res.text = text
+		}
+	}
+	if post.copyHistory != nil {
+		res.copyHistory = make([]preparedPost, len(post.copyHistory))
+		// the last post of copy history is the one reposted by the post itself
+		for i := range post.copyHistory {
+			res.copyHistory[i] = t.renderPost(&post.copyHistory[i], depth+len(post.copyHistory)-i)
+		}
+	}
+	return res
+}
+
+// apply returns copies of posts with rendered text
+func (t *postTemplate) apply(posts []preparedPost) []preparedPost {
+	if t == nil {
+		return posts
+	}
+	res := make([]preparedPost, len(posts))
+	for i := range posts {
+		res[i] = t.renderPost(&posts[i], 0)
+	}
+	return res
+}
+
+// readTemplates sets templates of subscriptions read from db
+func (cp *Crossposter) readTemplates() error {
+	rows, err := cp.db.Query(`select pubSub.pubSubID, pubSub.pubID, pubSub.subID, templates.template from templates
+join pubSub on templates.pubSubID = pubSub.pubSubID;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubSubID, pubID, subID int64
+		var text string
+		if err = rows.Scan(&pubSubID, &pubID, &subID, &text); err != nil {
+			return err
+		}
+		tmpl, err := newPostTemplate(text)
+		if err != nil {
+			log.Printf("Invalid template of pubSub %d, it is ignored:\n%s\n", pubSubID, err.Error())
+			continue
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.template = tmpl })
+	}
+	return rows.Err()
+}
+
+func (cp *Crossposter) handleTemplate(c tele.Context) error {
+	pubSubID, pubID, subID, text, err := cp.findOwnedPubSub(c, cp.templateMsgRegex)
+	if err != nil {
+		return err
+	}
+	lang := getLang(c)
+
+	switch strings.TrimSpace(text) {
+	case "":
+		err = cp.db.QueryRow("select template from templates where pubSubID=?;", pubSubID).Scan(&text)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Send(fmt.Sprintf(i18n[lang].noTemplate, pubSubID))
+		}
+		if err != nil {
+			return err
+		}
+		return c.Send(fmt.Sprintf(i18n[lang].templateSet, pubSubID, html.EscapeString(text)))
+	case "clear":
+		if _, err = cp.db.Exec("delete from templates where pubSubID=?;", pubSubID); err != nil {
+			return err
+		}
+		cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.template = nil })
+		return c.Send(fmt.Sprintf(i18n[lang].noTemplate, pubSubID))
+	}
+	tmpl, err := newPostTemplate(text)
+	if err != nil {
+		return userError{code: errInvalidTemplate, vkUserOrGroup: err.Error()}
+	}
+	_, err = cp.db.Exec("insert or replace into templates (pubSubID, template) values (?, ?);", pubSubID, text)
+	if err != nil {
+		return err
+	}
+	cp.ps.updateSubscription(subID, pubID, func(s *subscription) { s.template = tmpl })
+	return c.Send(fmt.Sprintf(i18n[lang].templateSet, pubSubID, html.EscapeString(text)))
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestNewPostTemplateRejectsLoops(t *testing.T) {
+	for _, text := range []string{
+		`{{range 100000000000}}{{end}}`,
+		`{{range .Text}}x{{end}}`,
+		`{{define "x"}}{{end}}{{.Text}}`,
+		`{{template "post" .}}`,
+		`{{printf "%999999999d" 1}}`,
+		`{{if .Text}}{{range 5}}{{end}}{{end}}`,
+	} {
+		if _, err := newPostTemplate(text); err == nil {
+			t.Errorf("template %s is accepted", text)
+		}
+	}
+}
+
+func TestPostTemplateRender(t *testing.T) {
+	tmpl, err := newPostTemplate(`{{if .Author}}{{.Author}}: {{end}}{{.Text}}{{with .SourceURL}} — {{link . $.SourceName}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := preparedPost{text: "hello", author: "Ann", Link: postLink{"https://vk.com/wall1_2", "Group [1]"}}
+	got, err := tmpl.render(&post, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Ann: hello — [https://vk.com/wall1_2|Group (1)]"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
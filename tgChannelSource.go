@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceTelegram = "tg"
+
+// posts of an album come as separate updates, we wait
+// for the rest of them this long after the last one
+const tgAlbumWait = 2 * time.Second
+
+// @channel or -100... id of a private channel
+var tgSourceRegex = regexp.MustCompile(`^(?:@[a-zA-Z][0-9a-zA-Z_]{4,}|-100[0-9]+)$`)
+
+type tgAlbum struct {
+	pubID int64
+	msgs  []*tele.Message
+	timer *time.Timer
+}
+
+// tgChannelSource mirrors posts of telegram channels where the bot is admin.
+// Key is the chat id. Telegram pushes posts to the bot, so nothing is polled.
+// Media is passed by telegram file ids which only make sense to this bot,
+// so such publishers can only be subscribed by telegram chats and vk walls,
+// which download files through the bot.
+type tgChannelSource struct {
+	cp     *Crossposter
+	mu     sync.Mutex
+	albums map[string]*tgAlbum
+}
+
+func newTgChannelSource(cp *Crossposter) *tgChannelSource {
+	s := &tgChannelSource{cp: cp, albums: make(map[string]*tgAlbum)}
+	cp.tgBot.Handle(tele.OnChannelPost, s.handle)
+	cp.tgBot.Handle(tele.OnEditedChannelPost, s.handleEdit)
+	return s
+}
+
+func (s *tgChannelSource) Type() string {
+	return sourceTelegram
+}
+
+func (s *tgChannelSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	if !tgSourceRegex.MatchString(addr) {
+		return "", false, nil
+	}
+	var chat *tele.Chat
+	var err error
+	if strings.HasPrefix(addr, "@") {
+		chat, err = s.cp.tgBot.ChatByUsername(addr)
+	} else {
+		id, _ := strconv.ParseInt(addr, 10, 64)
+		chat, err = s.cp.tgBot.ChatByID(id)
+	}
+	if err != nil || chat.Type != tele.ChatChannel {
+		return "", true, userError{code: errNoSuchChannel, tgUserOrGroup: addr}
+	}
+	// the bot gets posts only from channels where it's admin, and only
+	// admins of the channel can mirror it, even if it's public
+	if !s.cp.isUserAdmin(s.cp.tgBot.Me.ID, chat.ID) || !s.cp.isUserAdmin(c.Sender().ID, chat.ID) {
+		return "", true, userError{code: errUserNotAdmin}
+	}
+	return strconv.FormatInt(chat.ID, 10), true, nil
+}
+
+func (s *tgChannelSource) Describe(key string) string {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "[DELETED]"
+	}
+	name, err := s.cp.ResolveTgID(id)
+	if err != nil {
+		return "[DELETED]"
+	}
+	return name
+}
+
+func (s *tgChannelSource) InitialCursor(key string) int64 {
+	return 0
+}
+
+func (s *tgChannelSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+}
+
+// publisher returns id of the publisher of the channel or 0 if it isn't followed
+func (s *tgChannelSource) publisher(chat *tele.Chat) int64 {
+	var pubID, lastPost int64
+	err := s.cp.dbFindPubStmt.QueryRow(sourceTelegram, strconv.FormatInt(chat.ID, 10)).Scan(&pubID, &lastPost)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to find publisher for channel %d:\n%s\n", chat.ID, err.Error())
+	}
+	return pubID
+}
+
+// handleEdit publishes edited post for sinks which can apply edits.
+// An edit of a message from an album only changes the text,
+// because the post made of the album has media of all its messages.
+func (s *tgChannelSource) handleEdit(c tele.Context) error {
+	msg := c.Message()
+	if msg == nil || msg.Chat == nil {
+		return nil
+	}
+	pubID := s.publisher(msg.Chat)
+	if pubID == 0 {
+		return nil
+	}
+	post := prepareTgMessages([]*tele.Message{msg})
+	post.edited = true
+	if msg.AlbumID != "" {
+		post.att.media = preparedMedia{}
+	}
+	s.cp.publish(pubID, []preparedPost{post})
+	return nil
+}
+
+func (s *tgChannelSource) handle(c tele.Context) error {
+	msg := c.Message()
+	if msg == nil || msg.Chat == nil {
+		return nil
+	}
+	pubID := s.publisher(msg.Chat)
+	if pubID == 0 {
+		return nil
+	}
+	if msg.AlbumID == "" {
+		s.cp.publish(pubID, []preparedPost{prepareTgMessages([]*tele.Message{msg})})
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	album, exists := s.albums[msg.AlbumID]
+	if !exists {
+		album = &tgAlbum{pubID: pubID}
+		albumID := msg.AlbumID
+		album.timer = time.AfterFunc(tgAlbumWait, func() {
+			s.mu.Lock()
+			delete(s.albums, albumID)
+			s.mu.Unlock()
+			sort.Slice(album.msgs, func(i, j int) bool {
+				return album.msgs[i].ID < album.msgs[j].ID
+			})
+			s.cp.publish(album.pubID, []preparedPost{prepareTgMessages(album.msgs)})
+		})
+		s.albums[albumID] = album
+	} else {
+		album.timer.Reset(tgAlbumWait)
+	}
+	album.msgs = append(album.msgs, msg)
+	return nil
+}
+
+// tgEntitiesToText converts text links into inline links of our text model,
+// other formatting is lost. Entity offsets are in utf-16 code units.
+func tgEntitiesToText(text string, entities tele.Entities) string {
+	u := utf16.Encode([]rune(text))
+	var b strings.Builder
+	pos := 0
+	for _, e := range entities {
+		if e.Type != tele.EntityTextLink || e.Offset < pos || e.Offset+e.Length > len(u) {
+			continue
+		}
+		b.WriteString(string(utf16.Decode(u[pos:e.Offset])))
+		linkText := string(utf16.Decode(u[e.Offset : e.Offset+e.Length]))
+		b.WriteString("[" + e.URL + "|" + strings.NewReplacer("[", "(", "]", ")", "|", "/").Replace(linkText) + "]")
+		pos = e.Offset + e.Length
+	}
+	b.WriteString(string(utf16.Decode(u[pos:])))
+	return b.String()
+}
+
+func tgMessageLink(chat *tele.Chat, msgID int) string {
+	if chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, msgID)
+	}
+	// private channels are linked by id without -100 prefix
+	return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(strconv.FormatInt(chat.ID, 10), "-100"), msgID)
+}
+
+func tgMessageMedia(media *preparedMedia, msg *tele.Message) {
+	switch {
+	case msg.Photo != nil:
+		media[mediaPhotoVideo] = append(media[mediaPhotoVideo], mediaItem{tgFileID: msg.Photo.FileID})
+	case msg.Video != nil:
+		media[mediaPhotoVideo] = append(media[mediaPhotoVideo], mediaItem{tgFileID: msg.Video.FileID, isVideo: true})
+	case msg.Audio != nil:
+		media[mediaAudio] = append(media[mediaAudio], mediaItem{
+			tgFileID:  msg.Audio.FileID,
+			title:     msg.Audio.Title,
+			performer: msg.Audio.Performer,
+		})
+	// voice messages and animations can't be sent in albums, so they're skipped
+	case msg.Document != nil && msg.Animation == nil:
+		media[mediaDoc] = append(media[mediaDoc], mediaItem{tgFileID: msg.Document.FileID, title: msg.Document.FileName})
+	}
+}
+
+// prepareTgMessages makes a post of a single message or an album.
+// Messages forwarded from other channels are treated like vk reposts.
+func prepareTgMessages(msgs []*tele.Message) preparedPost {
+	first := msgs[0]
+	post := preparedPost{
+		att:     preparedAttachments{preparedMedia{}, []string{}},
+		ownerID: int(first.Chat.ID),
+		ID:      first.ID,
+		date:    first.Unixtime,
+		author:  first.Signature,
+		Link: postLink{
+			rawPostLink: tgMessageLink(first.Chat, first.ID),
+			name:        first.Chat.Title,
+		},
+	}
+	content := &post
+	if first.OriginalChat != nil {
+		post.copyHistory = []preparedPost{{
+			att:     preparedAttachments{preparedMedia{}, []string{}},
+			ownerID: int(first.OriginalChat.ID),
+			ID:      first.OriginalMessageID,
+			date:    int64(first.OriginalUnixtime),
+			Link: postLink{
+				rawPostLink: tgMessageLink(first.OriginalChat, first.OriginalMessageID),
+				name:        first.OriginalChat.Title,
+			},
+		}}
+		content = &post.copyHistory[0]
+	}
+	for _, msg := range msgs {
+		if content.text == "" {
+			if msg.Text != "" {
+				content.text = tgEntitiesToText(msg.Text, msg.Entities)
+			} else {
+				content.text = tgEntitiesToText(msg.Caption, msg.CaptionEntities)
+			}
+		}
+		tgMessageMedia(&content.att.media, msg)
+	}
+	return post
+}
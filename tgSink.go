@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkTelegram = "tg"
+
+var tgDestRegex = regexp.MustCompile(`^(?:(?:@[a-zA-Z][0-9a-zA-Z_]{4,})|(?:-?[0-9]+)|me)$`)
+
+// tgSender is the part of telegram bot api used for delivery,
+// so that rendering can work with something other than a real bot
+type tgSender interface {
+	Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error)
+	SendAlbum(to tele.Recipient, a tele.Album, caption string, opts ...interface{}) ([]tele.Message, error)
+}
+
+// tgSink sends posts to telegram users, chats and channels.
+// Key is the chat id.
+type tgSink struct {
+	cp  *Crossposter
+	bot tgSender
+}
+
+func (s *tgSink) Type() string {
+	return sinkTelegram
+}
+
+func (s *tgSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	if !tgDestRegex.MatchString(addr) {
+		return "", "", false, nil
+	}
+	userID := c.Sender().ID
+	if addr == "me" {
+		return strconv.FormatInt(userID, 10), c.Sender().FirstName + c.Sender().LastName, true, nil
+	}
+	tgId, err := s.cp.ResolveTgName(addr)
+	if err != nil {
+		return "", "", true, userError{code: errNoSuchChannel, tgUserOrGroup: addr}
+	}
+	if !s.cp.isUserAdmin(userID, tgId) {
+		return "", "", true, userError{code: errUserNotAdmin} // this return is a single thing that prevents users from messing each other's subscriptions
+	}
+	return strconv.FormatInt(tgId, 10), addr, true, nil
+}
+
+func (s *tgSink) Describe(key string) string {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "[DELETED]"
+	}
+	name, err := s.cp.ResolveTgID(id)
+	if err != nil {
+		return "[DELETED]"
+	}
+	return name
+}
+
+func (s *tgSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	chatID, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat id %s", key)
+	}
+	opts := tele.SendOptions{
+		ParseMode: "HTML",
+	}
+	if replyTo != "" {
+		replyID, _ := strconv.Atoi(string(replyTo))
+		opts.ReplyTo = &tele.Message{ID: replyID}
+	}
+	msg, err := s.forwardSinglePost(post, flags, chatID, opts)
+	if msg == nil {
+		return "", err
+	}
+	return msgRef(strconv.Itoa(msg.ID)), err
+}
+
+// tgPostLink is a link to the source rendered in telegram html
+// and the number of characters it takes in a message
+type tgPostLink struct {
+	formattedPostLink string
+	rawPostLink       string
+	postLinkTextLen   int
+}
+
+func makeTgPostLink(link postLink) tgPostLink {
+	return tgPostLink{
+		fmt.Sprintf("[<a href = '%s'>%s</a>]", link.rawPostLink, html.EscapeString(link.name)),
+		link.rawPostLink,
+		len([]rune(link.name)) + 2,
+	}
+}
+
+func renderTgHTML(text string) string {
+	return renderInlineLinks(text, html.EscapeString, func(url string, text string) string {
+		return fmt.Sprintf("<a href='%s'>%s</a>", html.EscapeString(url), html.EscapeString(text))
+	})
+}
+
+func downloadMedia(url string) (io.ReadCloser, error) {
+	r, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, fmt.Errorf("got status %s for %s", r.Status, url)
+	}
+	return r.Body, nil
+}
+
+// tgFileAlbumItem makes album item of media which is already in telegram
+func tgFileAlbumItem(mediaType int, m mediaItem) tele.Inputtable {
+	file := tele.File{FileID: m.tgFileID}
+	switch {
+	case mediaType == mediaDoc:
+		return &tele.Document{File: file}
+	case mediaType == mediaAudio:
+		return &tele.Audio{File: file, Title: m.title, Performer: m.performer}
+	case m.isVideo:
+		return &tele.Video{File: file}
+	}
+	return &tele.Photo{File: file}
+}
+
+// makeAlbum converts media of one type into telegram album. Photos and documents
+// are fetched by telegram itself, audio and video we have to download.
+// Returned bodies must be closed after the album is sent.
+func makeAlbum(mediaType int, items []mediaItem) (tele.Album, []io.Closer) {
+	album := tele.Album{}
+	bodies := []io.Closer{}
+	for _, m := range items {
+		if m.tgFileID != "" {
+			album = append(album, tgFileAlbumItem(mediaType, m))
+			continue
+		}
+		if mediaType == mediaDoc {
+			album = append(album, &tele.Document{File: tele.FromURL(m.url)})
+			continue
+		}
+		if mediaType == mediaPhotoVideo && !m.isVideo {
+			album = append(album, &tele.Photo{File: tele.FromURL(m.url)})
+			continue
+		}
+		body, err := downloadMedia(m.url)
+		if err != nil {
+			log.Printf("Failed to get media from url %s\n%s\n", m.url, err.Error())
+			continue
+		}
+		bodies = append(bodies, body)
+		if mediaType == mediaAudio {
+			album = append(album, &tele.Audio{
+				File:      tele.FromReader(body),
+				Title:     m.title,
+				Performer: m.performer,
+			})
+		} else {
+			album = append(album, &tele.Video{
+				File: tele.FromReader(body),
+			})
+		}
+	}
+	return album, bodies
+}
+
+func (s *tgSink) sendText(text string, link tgPostLink, chat int64, opts tele.SendOptions) (*tele.Message, error) {
+	text = strings.Trim(text, " \t\n")
+	if len(text) == 0 {
+		return nil, nil
+	}
+	if len(text) > 0 && link.postLinkTextLen > 0 {
+		text = text + "\n\n"
+	}
+
+	var firstMsg *tele.Message
+	appendedLink := false
+	maxMsgSize := 4096
+	for len(text) > 0 || (len(link.formattedPostLink) > 0 && !appendedLink) {
+		splitIndex, msgLen := findIndexToSplit(text, maxMsgSize)
+
+		msgText := renderTgHTML(text[0:splitIndex])
+		// if text fits in one message, check if it will fit with link too
+		if splitIndex == len(text) && msgLen+link.postLinkTextLen <= maxMsgSize {
+			msgText = msgText + link.formattedPostLink
+			appendedLink = true
+		}
+
+		newMsg, err := s.bot.Send(tele.ChatID(chat), msgText, &opts)
+		time.Sleep(time.Second * 4)
+		if err != nil {
+			return firstMsg, fmt.Errorf("failed to send text message:\n%w", err)
+		}
+
+		if firstMsg == nil {
+			firstMsg = newMsg
+		}
+		opts.ReplyTo = newMsg
+		text = strings.TrimLeft(text[splitIndex:], " \t\n")
+	}
+	return firstMsg, nil
+}
+func (s *tgSink) sendWithAttachments(text string, link tgPostLink, id int64, att preparedAttachments, opts tele.SendOptions) (*tele.Message, error) {
+
+	if len(att.links) != 0 {
+		text = text + "\n" + strings.Join(att.links, "\n")
+	}
+
+	maxMsgSize := 1024
+	_, msgSize := findIndexToSplit(text, 999999) // count rendered characters in a text
+	if link.postLinkTextLen > 0 {
+		if msgSize > 0 {
+			msgSize += 2 // two newlines
+			text = text + "\n\n"
+		}
+		msgSize += link.postLinkTextLen
+	}
+	var firstMsg *tele.Message = nil
+	if msgSize > maxMsgSize || att.media.Empty() {
+		var err error
+		firstMsg, err = s.sendText(text, link, id, opts)
+		if err != nil {
+			log.Printf("Failed to send text for post %s:\n%s\n", link.rawPostLink, err.Error())
+		}
+		text = text[:0]
+		opts.ReplyTo = firstMsg
+	} else {
+		text = renderTgHTML(text) + link.formattedPostLink
+	}
+	for mediaType := range att.media {
+		if len(att.media[mediaType]) == 0 {
+			continue
+		}
+		album, bodies := makeAlbum(mediaType, att.media[mediaType])
+		if len(album) == 0 {
+			continue
+		}
+		msg, err := s.bot.SendAlbum(tele.ChatID(id), album, text, &opts)
+		for _, b := range bodies {
+			b.Close()
+		}
+		// simplest way to not exceed 20 messages per minute
+		time.Sleep(time.Second * 4 * time.Duration(len(album)))
+		if err != nil {
+			if len(text) > 0 {
+				// if we failed to send text, give up and return,
+				// otherwise continue trying to send other attachments.
+				return nil, fmt.Errorf("failed to send attachment with text:\n%w", err)
+			}
+			log.Printf("Failed to send attachment for post %s:\n%s\n", link.rawPostLink, err.Error())
+		}
+
+		// we post attachments as a reply to initial message, while the initial message may be a reply
+		// to another message passed in opts in case of repost chains
+		if firstMsg == nil && len(msg) > 0 {
+			firstMsg = &msg[0]
+			opts.ReplyTo = firstMsg
+		}
+		text = text[:0]
+
+	}
+	if len(text) > 0 {
+		// none of the attachments could be fetched, but we still have a caption
+		newMsg, err := s.bot.Send(tele.ChatID(id), text, &opts)
+		time.Sleep(time.Second * 4)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send caption as text:\n%w", err)
+		}
+		firstMsg = newMsg
+	}
+	return firstMsg, nil
+}
+
+func (s *tgSink) forwardSinglePost(post *preparedPost, flags uint64, chatID int64, opts tele.SendOptions) (*tele.Message, error) {
+
+	link := tgPostLink{rawPostLink: post.Link.rawPostLink}
+	if flags&flagAddLinkToPost != 0 && post.Link.rawPostLink != "" {
+		link = makeTgPostLink(post.Link)
+	}
+
+	if post.att.Empty() {
+		return s.sendText(post.text, link, chatID, opts)
+	}
+	return s.sendWithAttachments(post.text, link, chatID, post.att, opts)
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestRenderTgHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain text is escaped", "a < b & c", "a &lt; b &amp; c"},
+		{"url", "[https://example.org/?a=1&b=2|site]", "<a href='https://example.org/?a=1&amp;b=2'>site</a>"},
+		{"quote in url", "[https://e.org/'x|q]", "<a href='https://e.org/&#39;x'>q</a>"},
+		{"vk user", "[id1|Pavel Durov]", "<a href='https://vk.com/id1'>Pavel Durov</a>"},
+		{"vk group text is escaped", "[club1|<Group>]", "<a href='https://vk.com/club1'>&lt;Group&gt;</a>"},
+		{"vk screen name", "[vk.com/durov|Durov]", "<a href='https://vk.com/durov'>Durov</a>"},
+		{"several links", "before [id1|A] and [https://x.org|B] after",
+			"before <a href='https://vk.com/id1'>A</a> and <a href='https://x.org'>B</a> after"},
+		{"brackets without link", "[not a link]", "[not a link]"},
+		{"link without text", "[https://x.org|]", "[https://x.org|]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderTgHTML(tt.text); got != tt.want {
+				t.Errorf("renderTgHTML(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	vkObject "github.com/SevereCloud/vksdk/v2/object"
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceVkAlbum = "vk-album"
+
+// photos uploaded with pauses shorter than this are sent together
+const vkAlbumGroupGap = 10 * 60
+
+// vk.com/album-123_456 for one album or vk.com/albums-123 for all albums of the page
+var vkAlbumRegex = regexp.MustCompile(`^(?:https?://)?(?:m\.)?vk\.com/(?:album(-?[0-9]+)_([0-9]+)|albums(-?[0-9]+))$`)
+
+// vkAlbumSource polls new photos of vk albums. Key is owner_album
+// for a single album or owner id for all albums of the page.
+// Cursor is the upload time of the latest photo.
+type vkAlbumSource struct {
+	cp *Crossposter
+}
+
+func (s *vkAlbumSource) Type() string {
+	return sourceVkAlbum
+}
+
+// vkServiceAlbums maps ids of service albums in urls to their names in api
+var vkServiceAlbums = map[string]string{
+	"0":   "profile",
+	"00":  "wall",
+	"000": "saved",
+}
+
+func splitVkAlbumKey(key string) (int64, string) {
+	owner, album, _ := strings.Cut(key, "_")
+	ownerID, _ := strconv.ParseInt(owner, 10, 64)
+	if name, ok := vkServiceAlbums[album]; ok {
+		album = name
+	}
+	return ownerID, album
+}
+
+func (s *vkAlbumSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := vkAlbumRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	key, name := m[3], "albums"+m[3]
+	if key == "" {
+		key = m[1] + "_" + m[2]
+		name = "album" + key
+	}
+	if _, err := s.photos(key, 1); err != nil {
+		log.Printf("Failed to get photos of album %s:\n%s\n", key, err.Error())
+		return "", true, userError{code: errNoSuchAlbum, vkUserOrGroup: name}
+	}
+	return key, true, nil
+}
+
+func (s *vkAlbumSource) Describe(key string) string {
+	if strings.Contains(key, "_") {
+		return "vk.com/album" + key
+	}
+	return "vk.com/albums" + key
+}
+
+func (s *vkAlbumSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+// photos returns latest photos of the album or all albums, newest first
+func (s *vkAlbumSource) photos(key string, count int) ([]vkObject.PhotosPhoto, error) {
+	ownerID, album := splitVkAlbumKey(key)
+	if album != "" {
+		res, err := s.cp.vk.PhotosGet(vkApi.Params{
+			"owner_id": ownerID,
+			"album_id": album,
+			"rev":      1,
+			"count":    count,
+		})
+		return res.Items, err
+	}
+	res, err := s.cp.vk.PhotosGetAll(vkApi.Params{
+		"owner_id":          ownerID,
+		"count":             min(count, 200),
+		"no_service_albums": 1,
+	})
+	photos := make([]vkObject.PhotosPhoto, 0, len(res.Items))
+	for _, p := range res.Items {
+		photos = append(photos, p.PhotosPhoto)
+	}
+	return photos, err
+}
+
+func (s *vkAlbumSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		photos, err := s.photos(pub.key, s.cp.nPostsToFetch)
+		if err != nil {
+			log.Printf("Failed to get photos of album %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		newPhotos := []vkObject.PhotosPhoto{}
+		cursor := pub.cursor
+		for _, p := range photos {
+			if int64(p.Date) > pub.cursor && len(p.Sizes) > 0 {
+				newPhotos = append(newPhotos, p)
+			}
+			if int64(p.Date) > cursor {
+				cursor = int64(p.Date)
+			}
+		}
+		if len(newPhotos) > 0 {
+			emit(sourceUpdate{
+				pubID:  pub.id,
+				cursor: cursor,
+				posts:  s.preparePhotos(newPhotos),
+			})
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// preparePhotos groups photos uploaded to the same album at about the same
+// time into posts of up to ten photos, oldest first
+func (s *vkAlbumSource) preparePhotos(photos []vkObject.PhotosPhoto) []preparedPost {
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].Date != photos[j].Date {
+			return photos[i].Date < photos[j].Date
+		}
+		return photos[i].ID < photos[j].ID
+	})
+	posts := []preparedPost{}
+	start := 0
+	for i := range photos {
+		last := i == len(photos)-1
+		if !last && photos[i+1].AlbumID == photos[start].AlbumID &&
+			photos[i+1].Date-photos[i].Date < vkAlbumGroupGap && i+1-start < 10 {
+			continue
+		}
+		posts = append(posts, s.preparePhotoGroup(photos[start:i+1]))
+		start = i + 1
+	}
+	return posts
+}
+
+func (s *vkAlbumSource) preparePhotoGroup(photos []vkObject.PhotosPhoto) preparedPost {
+	first := photos[0]
+	post := preparedPost{
+		att:     preparedAttachments{preparedMedia{}, []string{}},
+		ownerID: first.OwnerID,
+		ID:      first.ID,
+		date:    int64(first.Date),
+		Link: postLink{
+			// link to the first photo opens it in the album
+			rawPostLink: fmt.Sprintf("https://vk.com/photo%d_%d", first.OwnerID, first.ID),
+		},
+	}
+	post.Link.name, _ = s.cp.vkNameById(int64(first.OwnerID))
+	texts := []string{}
+	for _, p := range photos {
+		post.att.media[mediaPhotoVideo] = append(post.att.media[mediaPhotoVideo], mediaItem{url: getPhotoUrl(p)})
+		if t := strings.TrimSpace(p.Text); t != "" {
+			texts = append(texts, t)
+		}
+	}
+	post.text = strings.Join(texts, "\n\n")
+	return post
+}
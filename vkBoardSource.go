@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	vkObject "github.com/SevereCloud/vksdk/v2/object"
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceVkBoard = "vk-board"
+
+// board.getComments returns at most 100 comments
+const vkMaxBoardComments = 100
+
+// topics only exist in communities, so the owner is always negative
+var vkTopicRegex = regexp.MustCompile(`^(?:https?://)?(?:m\.)?vk\.com/topic-([0-9]+)_([0-9]+)$`)
+
+// vkBoardSource forwards new comments of a topic in community discussions.
+// Key is group_topic with positive group id, cursor is the time of the latest comment.
+type vkBoardSource struct {
+	cp *Crossposter
+}
+
+func (s *vkBoardSource) Type() string {
+	return sourceVkBoard
+}
+
+func (s *vkBoardSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := vkTopicRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	key := m[1] + "_" + m[2]
+	if _, err := s.comments(key, 1); err != nil {
+		log.Printf("Failed to get comments of topic %s:\n%s\n", key, err.Error())
+		return "", true, userError{code: errNoSuchTopic, vkUserOrGroup: "topic-" + key}
+	}
+	return key, true, nil
+}
+
+func (s *vkBoardSource) Describe(key string) string {
+	return "vk.com/topic-" + key
+}
+
+func (s *vkBoardSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+// comments returns latest comments of the topic, newest first
+func (s *vkBoardSource) comments(key string, count int) ([]vkObject.BoardTopicComment, error) {
+	group, topic, _ := strings.Cut(key, "_")
+	res, err := s.cp.vk.BoardGetComments(vkApi.Params{
+		"group_id": group,
+		"topic_id": topic,
+		"sort":     "desc",
+		"count":    min(count, vkMaxBoardComments),
+	})
+	return res.Items, err
+}
+
+func (s *vkBoardSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		comments, err := s.comments(pub.key, s.cp.nPostsToFetch)
+		if err != nil {
+			log.Printf("Failed to get comments of topic %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		posts := []preparedPost{}
+		cursor := pub.cursor
+		// oldest first
+		for i := len(comments) - 1; i >= 0; i-- {
+			if int64(comments[i].Date) <= pub.cursor {
+				continue
+			}
+			posts = append(posts, s.prepareComment(pub.key, &comments[i]))
+			if int64(comments[i].Date) > cursor {
+				cursor = int64(comments[i].Date)
+			}
+		}
+		if len(posts) > 0 {
+			emit(sourceUpdate{
+				pubID:  pub.id,
+				cursor: cursor,
+				posts:  posts,
+			})
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// commentAsWallpost lets getAttachments handle attachments of the comment
+func commentAsWallpost(ownerID int, comment *vkObject.BoardTopicComment) vkObject.WallWallpost {
+	post := vkObject.WallWallpost{OwnerID: ownerID, ID: comment.ID}
+	for _, att := range comment.Attachments {
+		post.Attachments = append(post.Attachments, vkObject.WallWallpostAttachment{
+			Type:  att.Type,
+			Photo: att.Photo,
+			Audio: att.Audio,
+			Doc:   att.Doc,
+			Video: att.Video,
+		})
+	}
+	return post
+}
+
+func (s *vkBoardSource) prepareComment(key string, comment *vkObject.BoardTopicComment) preparedPost {
+	group, _, _ := strings.Cut(key, "_")
+	groupID, _ := strconv.Atoi(group)
+	wallpost := commentAsWallpost(-groupID, comment)
+	post := preparedPost{
+		att:     s.cp.getAttachments(&wallpost),
+		ownerID: -groupID,
+		ID:      comment.ID,
+		date:    int64(comment.Date),
+		text:    comment.Text,
+		Link: postLink{
+			rawPostLink: fmt.Sprintf("https://vk.com/topic-%s?post=%d", key, comment.ID),
+		},
+	}
+	post.Link.name, _ = s.cp.vkNameById(int64(-groupID))
+	if author, err := s.cp.resolveVkId(int64(comment.FromID)); err == nil {
+		mention := fmt.Sprintf("id%d", comment.FromID)
+		if comment.FromID < 0 {
+			mention = fmt.Sprintf("club%d", -comment.FromID)
+		}
+		post.text = "[" + mention + "|" + author.Name + "]:\n" + post.text
+		post.author = author.Name
+	}
+	return post
+}
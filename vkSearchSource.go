@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceVkSearch = "vk-search"
+
+// newsfeed.search returns at most 200 posts
+const vkMaxSearchResults = 200
+
+// quotes allow spaces in the query, see regexAddSub
+var vkSearchRegex = regexp.MustCompile(`^search:"([^"]+)"$`)
+
+// vkSearchSource collects public vk posts matching a keyword or a hashtag
+// with newsfeed.search. Key is the query, cursor is the time of the latest
+// found post and is passed as start_time. Posts come from arbitrary authors,
+// so they always have a link to the source.
+type vkSearchSource struct {
+	cp *Crossposter
+}
+
+func (s *vkSearchSource) Type() string {
+	return sourceVkSearch
+}
+
+func (s *vkSearchSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := vkSearchRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	query := strings.Join(strings.Fields(m[1]), " ")
+	if query == "" {
+		return "", true, userError{code: errInvalidRequest}
+	}
+	return query, true, nil
+}
+
+func (s *vkSearchSource) Describe(key string) string {
+	return "search:\"" + key + "\""
+}
+
+func (s *vkSearchSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+func (s *vkSearchSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		res, err := s.cp.vk.NewsfeedSearch(vkApi.Params{
+			"q":          pub.key,
+			"start_time": pub.cursor + 1,
+			"count":      min(s.cp.nPostsToFetch, vkMaxSearchResults),
+		})
+		time.Sleep(300 * time.Millisecond)
+		if err != nil {
+			log.Printf("Failed to search vk for %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		// results are newest first, like wall.get which preparePosts expects
+		found := res.Items[:0]
+		cursor := pub.cursor
+		for _, p := range res.Items {
+			if int64(p.Date) <= pub.cursor {
+				continue
+			}
+			found = append(found, p)
+			if int64(p.Date) > cursor {
+				cursor = int64(p.Date)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		posts := s.cp.preparePosts(found, true /*HandleReposts*/)
+		for i := range posts {
+			posts[i].alwaysLink = true
+		}
+		emit(sourceUpdate{
+			pubID:  pub.id,
+			cursor: cursor,
+			posts:  posts,
+		})
+	}
+}
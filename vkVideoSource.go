@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	vkObject "github.com/SevereCloud/vksdk/v2/object"
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceVkVideo = "vk-video"
+
+var vkVideoRegex = regexp.MustCompile(`^(?:https?://)?(?:m\.)?vk\.com/videos(-?[0-9]+)$`)
+
+// vkVideoSource polls the video section of a vk page. Key is the owner id,
+// cursor is the time when the latest video was added to the section.
+type vkVideoSource struct {
+	cp *Crossposter
+}
+
+func (s *vkVideoSource) Type() string {
+	return sourceVkVideo
+}
+
+func (s *vkVideoSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := vkVideoRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	if _, err := s.videos(m[1], 1); err != nil {
+		log.Printf("Failed to get videos of %s:\n%s\n", m[1], err.Error())
+		return "", true, userError{code: errNoSuchVideos, vkUserOrGroup: "videos" + m[1]}
+	}
+	return m[1], true, nil
+}
+
+func (s *vkVideoSource) Describe(key string) string {
+	return "vk.com/videos" + key
+}
+
+func (s *vkVideoSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+// videos returns latest videos of the owner, newest first. Links to files
+// are only given to user tokens, so audio token is used like in getVideo.
+func (s *vkVideoSource) videos(key string, count int) ([]vkObject.VideoVideo, error) {
+	res, err := s.cp.vkAudio.VideoGet(vkApi.Params{
+		"owner_id": key,
+		"count":    min(count, 200),
+	})
+	return res.Items, err
+}
+
+// videoAddedAt is the time when video appeared in the section,
+// videos of other owners can be added long after upload
+func videoAddedAt(v *vkObject.VideoVideo) int64 {
+	if v.AddingDate != 0 {
+		return int64(v.AddingDate)
+	}
+	return int64(v.Date)
+}
+
+func (s *vkVideoSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	for _, pub := range pubs {
+		videos, err := s.videos(pub.key, s.cp.nPostsToFetch)
+		if err != nil {
+			log.Printf("Failed to get videos of %s:\n%s\n", pub.key, err.Error())
+			continue
+		}
+		newVideos := []vkObject.VideoVideo{}
+		cursor := pub.cursor
+		for i := range videos {
+			added := videoAddedAt(&videos[i])
+			if added > pub.cursor {
+				newVideos = append(newVideos, videos[i])
+			}
+			if added > cursor {
+				cursor = added
+			}
+		}
+		sort.Slice(newVideos, func(i, j int) bool {
+			return videoAddedAt(&newVideos[i]) < videoAddedAt(&newVideos[j])
+		})
+		posts := make([]preparedPost, 0, len(newVideos))
+		for i := range newVideos {
+			posts = append(posts, s.prepareVideoPost(&newVideos[i]))
+		}
+		if len(posts) > 0 {
+			emit(sourceUpdate{
+				pubID:  pub.id,
+				cursor: cursor,
+				posts:  posts,
+			})
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+func (s *vkVideoSource) prepareVideoPost(v *vkObject.VideoVideo) preparedPost {
+	post := preparedPost{
+		att:     preparedAttachments{preparedMedia{}, []string{}},
+		ownerID: v.OwnerID,
+		ID:      v.ID,
+		date:    videoAddedAt(v),
+		text:    strings.Trim(v.Title+"\n\n"+v.Description, " \t\n"),
+		Link: postLink{
+			rawPostLink: fmt.Sprintf("https://vk.com/video%d_%d", v.OwnerID, v.ID),
+		},
+	}
+	post.Link.name, _ = s.cp.vkNameById(int64(v.OwnerID))
+	if m, link := prepareVideo(v); link != "" {
+		post.att.links = append(post.att.links, link)
+	} else {
+		post.att.media[mediaPhotoVideo] = append(post.att.media[mediaPhotoVideo], m)
+	}
+	return post
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+	tele "gopkg.in/telebot.v3"
+)
+
+const sinkVkWall = "vk"
+
+// vk allows 10 attachments per post
+const vkMaxAttachments = 10
+
+var vkMentionRegex = regexp.MustCompile(`^https://vk\.com/((?:club|id)[0-9]+)$`)
+
+// vkWallSink publishes posts on walls of vk communities with the write
+// token from config. Key is the owner id of the wall. Every published post
+// is stored in vkWallPosts table by the link to its source, so that edits
+// of the source can be applied to it.
+type vkWallSink struct {
+	cp *Crossposter
+	vk *vkApi.VK
+}
+
+func newVkWallSink(cp *Crossposter, cfg CrossposterConfig) *vkWallSink {
+	s := &vkWallSink{cp: cp}
+	if cfg.VkWriteToken != "" {
+		s.vk = vkApi.NewVK(cfg.VkWriteToken)
+	}
+	return s
+}
+
+func (s *vkWallSink) Type() string {
+	return sinkVkWall
+}
+
+func (s *vkWallSink) Resolve(addr string, c tele.Context) (string, string, bool, error) {
+	m := vkWallRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", "", false, nil
+	}
+	if s.vk == nil {
+		return "", "", true, userError{code: errNotConfigured}
+	}
+	if !s.cp.isUserBotAdmin(c.Sender().ID) {
+		return "", "", true, userError{code: errBotAdminOnly}
+	}
+	id, err := s.cp.resolveVkName(m[1])
+	if err != nil {
+		return "", "", true, err
+	}
+	// community token returns its own community without group_ids
+	groups, err := s.vk.GroupsGetByID(vkApi.Params{})
+	if err != nil || id >= 0 || (len(groups) > 0 && -int64(groups[0].ID) != id) {
+		return "", "", true, userError{code: errVkWriteDenied, vkUserOrGroup: m[1]}
+	}
+	return strconv.FormatInt(id, 10), "vk.com/" + m[1], true, nil
+}
+
+func (s *vkWallSink) Describe(key string) string {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "[DELETED]"
+	}
+	name, err := s.cp.vkScreenNameById(id)
+	if err != nil {
+		return "[DELETED]"
+	}
+	return fmt.Sprintf(i18n["ru"].vkWallTo, name)
+}
+
+func renderVkText(text string) string {
+	return renderInlineLinks(text, func(s string) string { return s }, func(url string, text string) string {
+		if m := vkMentionRegex.FindStringSubmatch(url); m != nil {
+			return "[" + m[1] + "|" + text + "]"
+		}
+		if text == url {
+			return url
+		}
+		return text + " (" + url + ")"
+	})
+}
+
+// openMedia gets the file from telegram if it came from there or by url otherwise
+func (s *vkWallSink) openMedia(m mediaItem) (io.ReadCloser, error) {
+	if m.tgFileID != "" {
+		return s.cp.tgBot.File(&tele.File{FileID: m.tgFileID})
+	}
+	return downloadMedia(m.url)
+}
+
+func (s *vkWallSink) upload(groupID int, mediaType int, m mediaItem) (string, error) {
+	body, err := s.openMedia(m)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if mediaType == mediaPhotoVideo {
+		photos, err := s.vk.UploadGroupWallPhoto(groupID, body)
+		if err != nil || len(photos) == 0 {
+			return "", fmt.Errorf("failed to upload photo: %v", err)
+		}
+		return photos[0].ToAttachment(), nil
+	}
+	title := m.title
+	if title == "" {
+		title = "file"
+	}
+	doc, err := s.vk.UploadGroupWallDoc(groupID, title, "", body)
+	if err != nil {
+		return "", err
+	}
+	return doc.Doc.ToAttachment(), nil
+}
+
+// prepare uploads photos and documents and returns text and attachments of
+// the wall post. Audio and video can't be uploaded by community, so they're linked.
+func (s *vkWallSink) prepare(ownerID int64, post *preparedPost, flags uint64) (string, []string) {
+	text := strings.Trim(post.text, " \t\n")
+	if len(post.att.links) != 0 {
+		text = strings.TrimLeft(text+"\n"+strings.Join(post.att.links, "\n"), "\n")
+	}
+	attachments := []string{}
+	for mediaType := range post.att.media {
+		for _, m := range post.att.media[mediaType] {
+			if mediaType == mediaAudio || m.isVideo || len(attachments) == vkMaxAttachments {
+				if m.url != "" {
+					text = strings.TrimLeft(text+"\n"+m.url, "\n")
+				}
+				continue
+			}
+			att, err := s.upload(int(-ownerID), mediaType, m)
+			if err != nil {
+				log.Printf("Failed to upload %s to vk:\n%s\n", m.url, err.Error())
+				continue
+			}
+			attachments = append(attachments, att)
+		}
+	}
+	text = renderVkText(text)
+	if flags&flagAddLinkToPost != 0 && post.Link.rawPostLink != "" {
+		text = strings.TrimLeft(text+"\n\n"+post.Link.name+": "+post.Link.rawPostLink, "\n")
+	}
+	return text, attachments
+}
+
+func (s *vkWallSink) Deliver(key string, post *preparedPost, flags uint64, replyTo msgRef) (msgRef, error) {
+	ownerID, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid owner id %s", key)
+	}
+	text, attachments := s.prepare(ownerID, post, flags)
+	if text == "" && len(attachments) == 0 {
+		return "", nil
+	}
+	res, err := s.vk.WallPost(vkApi.Params{
+		"owner_id":    ownerID,
+		"from_group":  1,
+		"message":     text,
+		"attachments": strings.Join(attachments, ","),
+	})
+	if err != nil {
+		return "", err
+	}
+	if post.Link.rawPostLink != "" {
+		_, err = s.cp.db.Exec("insert or replace into vkWallPosts (srcLink, ownerID, postID, attachments) values (?, ?, ?, ?);",
+			post.Link.rawPostLink, ownerID, res.PostID, strings.Join(attachments, ","))
+		if err != nil {
+			log.Printf("Failed to save vk post %d_%d of %s:\n%s\n", ownerID, res.PostID, post.Link.rawPostLink, err.Error())
+		}
+	}
+	return msgRef(strconv.Itoa(res.PostID)), nil
+}
+
+// Edit applies an edit of the source post to the wall post made from it.
+// If the edited post has no media, attachments of the wall post are kept.
+func (s *vkWallSink) Edit(key string, post *preparedPost, flags uint64) error {
+	ownerID, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid owner id %s", key)
+	}
+	var postID int
+	var oldAttachments string
+	err = s.cp.db.QueryRow("select postID, attachments from vkWallPosts where srcLink=? and ownerID=?;",
+		post.Link.rawPostLink, ownerID).Scan(&postID, &oldAttachments)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	text, attachments := s.prepare(ownerID, post, flags)
+	newAttachments := strings.Join(attachments, ",")
+	if post.att.media.Empty() {
+		newAttachments = oldAttachments
+	}
+	_, err = s.vk.WallEdit(vkApi.Params{
+		"owner_id":    ownerID,
+		"post_id":     postID,
+		"message":     text,
+		"attachments": newAttachments,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.cp.db.Exec("update vkWallPosts set attachments=? where srcLink=? and ownerID=?;",
+		newAttachments, post.Link.rawPostLink, ownerID)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	vkApi "github.com/SevereCloud/vksdk/v2/api"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceVkWall = "vk"
+
+var vkWallRegex = regexp.MustCompile(`^(?:https?://)?(?:m\.)?vk\.com/([a-zA-Z0-9_\.]+)$`)
+
+// vkWallSource polls walls of vk users and groups with wall.get
+// batched into vk execute requests. Key is the owner id of the wall.
+type vkWallSource struct {
+	cp *Crossposter
+}
+
+func (s *vkWallSource) Type() string {
+	return sourceVkWall
+}
+
+func (s *vkWallSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	matches := vkWallRegex.FindStringSubmatch(addr)
+	if matches == nil {
+		return "", false, nil
+	}
+	id, err := s.cp.resolveVkName(matches[1])
+	if err != nil {
+		return "", true, err
+	}
+	return strconv.FormatInt(id, 10), true, nil
+}
+
+func (s *vkWallSource) Describe(key string) string {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return "[DELETED]"
+	}
+	name, err := s.cp.vkScreenNameById(id)
+	if err != nil {
+		return "[DELETED]"
+	}
+	return "vk.com/" + name
+}
+
+func (s *vkWallSource) InitialCursor(key string) int64 {
+	return time.Now().Unix()
+}
+
+func (s *vkWallSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+	batchSize := s.cp.batchSize
+	batch := make([]vkReqData, 0, batchSize)
+	withAds, err := s.cp.publishersWithAds()
+	allAds := err != nil
+	if allAds {
+		log.Printf("Failed to get publishers with ads, fetching ads of all of them: %s\n", err.Error())
+	}
+	for _, pub := range pubs {
+		owner, err := strconv.ParseInt(pub.key, 10, 64)
+		if err != nil {
+			log.Printf("Invalid vk wall key %s of publisher %d\n", pub.key, pub.id)
+			continue
+		}
+		batch = append(batch, vkReqData{
+			id:       pub.id,
+			owner:    owner,
+			lastPost: pub.cursor,
+			ads:      allAds || withAds[pub.id],
+		})
+		if len(batch) == batchSize {
+			s.processBatch(batch, emit)
+			time.Sleep(300 * time.Millisecond)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		s.processBatch(batch, emit)
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+func (s *vkWallSource) processBatch(batch []vkReqData, emit func(sourceUpdate)) {
+	var res []vkReqResult
+	err := s.cp.vk.Execute(makeJs(batch, s.cp.nPostsToFetch), &res)
+	if err != nil {
+		log.Printf("Failed to execute:\n%s\n", err.Error())
+		switch e := err.(type) {
+		case *vkApi.ExecuteErrors:
+			for _, exErr := range *e {
+				log.Printf("Method: %s Code: %d Message: %s\n", exErr.Method, exErr.Code, exErr.Msg)
+			}
+		default:
+			log.Println("Unknown error type: ", reflect.TypeOf(err))
+		}
+		return
+	}
+	for i := range res {
+		emit(sourceUpdate{
+			pubID:  res[i].Id,
+			cursor: res[i].LastPost,
+			posts:  s.cp.preparePosts(res[i].Posts, true /*HandleReposts*/),
+		})
+	}
+}
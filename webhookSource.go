@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const sourceWebhook = "webhook"
+
+// "webhook" creates a new one, "webhook:token" subscribes to an existing one
+var webhookRegex = regexp.MustCompile(`^webhook(?::([0-9a-f]{32}))?$`)
+
+// webhookPost is the json accepted by webhook endpoint
+type webhookPost struct {
+	Text  string   `json:"text"`
+	Media []string `json:"media"`
+	Link  string   `json:"link"`
+	// name of the source, used as link text
+	Name string `json:"name"`
+}
+
+// webhookSource receives posts pushed by other systems over http.
+// Key is the secret token which authenticates the requests.
+// Post it as json to /webhook with "Authorization: Bearer token" header
+// or to /webhook/token if the sender can't set headers.
+type webhookSource struct {
+	cp *Crossposter
+}
+
+func newWebhookSource(cp *Crossposter) *webhookSource {
+	s := &webhookSource{cp}
+	if cp.httpMux != nil {
+		cp.httpMux.HandleFunc("/webhook", s.handle)
+		cp.httpMux.HandleFunc("/webhook/", s.handle)
+	}
+	return s
+}
+
+func (s *webhookSource) Type() string {
+	return sourceWebhook
+}
+
+func newWebhookToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *webhookSource) Resolve(addr string, c tele.Context) (string, bool, error) {
+	m := webhookRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", false, nil
+	}
+	if s.cp.httpServer == nil {
+		return "", true, userError{code: errHttpDisabled}
+	}
+	if m[1] == "" {
+		token, err := newWebhookToken()
+		if err != nil {
+			return "", true, err
+		}
+		// descriptions get to logs and replies in groups, so the token
+		// is sent to the user once in private and nowhere else
+		lang := getLang(c)
+		_, err = s.cp.tgBot.Send(c.Sender(), fmt.Sprintf(i18n[lang].webhookUrl, s.cp.httpBaseUrl, token, token))
+		return token, true, err
+	}
+	// tokens are secret, so one can only subscribe to a webhook which already exists
+	var id, lastPost int64
+	err := s.cp.dbFindPubStmt.QueryRow(sourceWebhook, m[1]).Scan(&id, &lastPost)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", true, userError{code: errNoSuchWebhook}
+	}
+	if err != nil {
+		return "", true, err
+	}
+	return m[1], true, nil
+}
+
+// Describe leaves the token out, it's only known to the one who made the webhook
+func (s *webhookSource) Describe(key string) string {
+	return "webhook " + s.cp.httpBaseUrl + "/webhook"
+}
+
+func (s *webhookSource) InitialCursor(key string) int64 {
+	return 0
+}
+
+func (s *webhookSource) Poll(pubs []publisherRef, emit func(sourceUpdate)) {
+}
+
+func (s *webhookSource) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/webhook")
+	token = strings.TrimPrefix(token, "/")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	var pubID, lastPost int64
+	err := s.cp.dbFindPubStmt.QueryRow(sourceWebhook, token).Scan(&pubID, &lastPost)
+	if err != nil || token == "" {
+		http.Error(w, "unknown token", http.StatusUnauthorized)
+		return
+	}
+
+	var p webhookPost
+	err = json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&p)
+	if err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	post := prepareWebhookPost(&p)
+	if strings.TrimSpace(post.text) == "" && post.att.Empty() {
+		http.Error(w, "nothing to post", http.StatusBadRequest)
+		return
+	}
+	s.cp.publish(pubID, []preparedPost{post})
+	log.Printf("Received webhook post for publisher %d\n", pubID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mimeFromUrl guesses mime type of a file by its extension
+func mimeFromUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return mime.TypeByExtension(strings.ToLower(path.Ext(u.Path)))
+}
+
+func prepareWebhookPost(p *webhookPost) preparedPost {
+	att := preparedAttachments{preparedMedia{}, []string{}}
+	for _, m := range p.Media {
+		if m != "" {
+			mediaFromMime(&att.media, m, mimeFromUrl(m))
+		}
+	}
+	name := p.Name
+	if name == "" {
+		name = p.Link
+	}
+	return preparedPost{
+		att:  att,
+		text: p.Text,
+		Link: postLink{
+			rawPostLink: p.Link,
+			name:        name,
+		},
+	}
+}